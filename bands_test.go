@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testTiles are count tiles of width x height, each a gradient of its
+// own colour. Lazy tiles are loaded when drawn, like with -tile-lru.
+func testTiles(count, width, height int, lazy bool) []*TileImage {
+
+	tiles := make([]*TileImage, count)
+
+	for i := range tiles {
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				scaled.SetRGBA(x, y, color.RGBA{uint8(40 * i), uint8(255 * x / width), uint8(255 * y / height), 255})
+			}
+		}
+
+		tiles[i] = &TileImage{filename: string(rune('a' + i)), scaled: scaled}
+		if lazy {
+			tiles[i].scaled = nil
+			tiles[i].load = func() (image.Image, error) { return scaled, nil }
+		}
+	}
+
+	return tiles
+}
+
+// testTarget is a target image with some structure for the voronoi seeds
+func testTarget(width, height int) image.Image {
+
+	target := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			target.SetRGBA(x, y, color.RGBA{uint8(x * y), uint8(x), uint8(y), 255})
+		}
+	}
+
+	return target
+}
+
+// drawCells draws the cells overlapping each worker's band, clipped to
+// it; overlapping cells must end up drawn as by a single worker. Run
+// with -race to check the workers share no pixels.
+func TestDrawCellsWorkers(t *testing.T) {
+
+	target := testTarget(150, 110)
+
+	layouts := []struct {
+		name    string
+		options gridOptions
+		style   cellStyle
+	}{
+		{"hex", gridOptions{grid: "hex", hex: "pointy"},
+			cellStyle{shape: &cellShape{kind: "square"}, background: color.Black, gap: 4, gapColour: color.White,
+				bevel: 2, shadow: 3, filter: scaleFilter{name: "auto"}}},
+		{"flat hex", gridOptions{grid: "hex", hex: "flat"},
+			cellStyle{shape: &cellShape{kind: "circle"}, background: color.White, gap: 2, gapColour: color.Black,
+				shadow: 5, filter: scaleFilter{name: "bilinear"}}},
+		{"voronoi", gridOptions{grid: "voronoi", seeds: "poisson", cells: 40},
+			cellStyle{shape: &cellShape{kind: "rounded"}, background: color.Black, gap: 2, gapColour: color.Black,
+				bevel: 1, shadow: 2, filter: scaleFilter{name: "auto"}}},
+	}
+
+	integral, err := newIntegralImage(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, layout := range layouts {
+		cells, err := gridCells(context.Background(), target, integral, 15, 11, layout.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		width, height := cellsSize(cells)
+
+		for _, lazy := range []bool{false, true} {
+			tiles := testTiles(7, width, height, lazy)
+
+			matches := make([]*TileImage, len(cells))
+			for i := range matches {
+				matches[i] = tiles[i*5%len(tiles)]
+			}
+
+			var want *image.RGBA
+
+			for _, workers := range []int{1, 3, 8} {
+				mosaic := image.NewRGBA(target.Bounds())
+
+				// a small lru, so tiles are evicted and loaded again
+				err := drawCells(context.Background(), mosaic, cells, matches, newScaledTiles(2), &layout.style, workers, newStageTimes())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if want == nil {
+					want = mosaic
+				} else if !bytes.Equal(mosaic.Pix, want.Pix) {
+					t.Errorf("%s (lazy %v): %d workers draw another mosaic than 1 worker", layout.name, lazy, workers)
+				}
+			}
+		}
+	}
+}
@@ -7,18 +7,22 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/nfnt/resize"
 	"image"
-	"image/draw"
 	"image/jpeg"
-	"io/ioutil"
+	"io"
 	"log"
 	"math"
 	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -28,61 +32,75 @@ type Tile interface {
 
 type TileImage struct {
 	filename   string
+	variant    string
 	xMin       int
 	yMin       int
 	scaled     image.Image
 	averageRGB []float64
+	// scales lazily loaded tiles, their scaled is nil
+	load func() (image.Image, error)
 	//cornerPixel color.Color
 }
 
+// tileJob is a read tile waiting for the decode stage
+type tileJob struct {
+	library  string
+	filename string
+	load     loadTile
+}
+
 type tileMessage struct {
+	library  string
 	filename string
 	tile     *TileImage
 }
 
 // calculates tile photo colour
-func getTileColour(wg *sync.WaitGroup, xDelta int, filename string, tileImage image.Image,
-	tileData chan tileMessage) {
+func getTileColour(tile *TileImage) {
 
-	resizedTile := resize.Resize(uint(xDelta), 0, tileImage, resize.Lanczos3)
+	xMin := tile.scaled.Bounds().Min.X
+	xMax := tile.scaled.Bounds().Max.X
+	yMin := tile.scaled.Bounds().Min.Y
+	yMax := tile.scaled.Bounds().Max.Y
 
-	xMin := resizedTile.Bounds().Min.X
-	xMax := resizedTile.Bounds().Max.X
-	yMin := resizedTile.Bounds().Min.Y
-	yMax := resizedTile.Bounds().Max.Y
+	tile.averageRGB = getImageColour(tile.scaled, xMin, yMin, xMax, yMax)
 
-	averageRGB := getImageColour(resizedTile, xMin, yMin, xMax, yMax)
+	//fmt.Printf("\t\tgoroutines = %d - processing filename %s: %v\n", runtime.NumGoroutine(), tile.filename, tile)
+}
 
-	tile := &TileImage{
-		xMin:       tileImage.Bounds().Min.X,
-		yMin:       tileImage.Bounds().Min.Y,
-		averageRGB: averageRGB,
-		scaled:     resizedTile,
-	}
+// scales the tile to cover the whole width x height cell
+func scaleToCover(tileImage image.Image, width, height int, filter scaleFilter) image.Image {
 
-	message := tileMessage{
-		filename: filename,
-		tile:     tile,
+	if tileImage.Bounds().Dx()*height > tileImage.Bounds().Dy()*width {
+		return filter.resize(tileImage, 0, height)
 	}
 
-	tileData <- message
-
-	//fmt.Printf("\t\tgoroutines = %d - processing filename %s: %v\n", runtime.NumGoroutine(), filename, message)
-
-	wg.Done()
+	return filter.resize(tileImage, width, 0)
 }
 
 func getImageColour(image image.Image, xMin, yMin, xMax, yMax int) []float64 {
 
 	var rSum, gSum, bSum float64 = 0.0, 0.0, 0.0
 
-	for y := yMin; y <= yMax; y++ {
-		for x := xMin; x <= xMax; x++ {
+	// only pixels inside the image can be read
+	bounds := image.Bounds()
+	xMin, yMin = maxInt(xMin, bounds.Min.X), maxInt(yMin, bounds.Min.Y)
+	xMax, yMax = minInt(xMax, bounds.Max.X), minInt(yMax, bounds.Max.Y)
+
+	if xMax <= xMin || yMax <= yMin {
+		return []float64{0, 0, 0}
+	}
+
+	row := make([]uint32, 3*(xMax-xMin))
 
-			r, g, b, _ := image.At(x, y).RGBA()
-			rSum += float64(r)
-			gSum += float64(g)
-			bSum += float64(b)
+	for y := yMin; y < yMax; y++ {
+
+		readRow(image, y, xMin, xMax, row)
+
+		for i := 0; i < len(row); i += 3 {
+			rSum += float64(row[i])
+			gSum += float64(row[i+1])
+			bSum += float64(row[i+2])
 		}
 	}
 
@@ -98,26 +116,163 @@ func getImageColour(image image.Image, xMin, yMin, xMax, yMax int) []float64 {
 
 func main() {
 
+	if err := run(); err != nil {
+		log.Fatalf("\nERROR: %v\n\n", err)
+	}
+}
+
+func run() error {
+
 	imageDir := "./images/"
 
 	// get cli arguments
 	//		get the image path from the cli ... -i
 	//		get number of tiles in a row ...... -t
+	//		get extra tile variants ........... -augment
+	//		get placements output file ........ -placements
+	//		get self-mosaic tile source ....... -self, -self-image, -self-scales
+	//		get sprite sheet tile source ...... -sprite, -sprite-cell, -sprite-atlas
+	//		get archive tile sources .......... -archive
+	//		get animated gif tile sources ..... -gif
+	//		get synthetic tile source ......... -synth, -palette, -synth-size
+	//		get grid layout ................... -grid, -hex, -variance, -min-tile, -seeds, -cells
+	//		get tile shape .................... -shape, -shape-mask, -background
+	//		get grout and tile effects ........ -gap, -gap-colour, -bevel, -shadow
+	//		get per region tile libraries ..... -mask, -mask-library
+	//		get number of workers ............. -workers
+	//		get processing time limit ......... -timeout
+	//		get failing on bad tiles .......... -strict
+	//		get memory budget ................. -max-memory
+	//		get tile cache directory .......... -cache
+	//		get lazy tile loading ............. -tile-lru
+	//		get scaling filter and output size  -filter, -scale
+	//		get profiles and stage timings .... -cpuprofile, -memprofile, -trace, -timings
 	imageFile := flag.String("i", "origImage.jpg", "Image path")
 	tilesCount := flag.Int("t", 10, "Number of tiles along the image edge")
+	augment := flag.String("augment", "", "Extra tile variants, comma separated: rotate, flip, hue, grey")
+	placementsFile := flag.String("placements", "", "Write the tile placements as csv into this file")
+	self := flag.Bool("self", false, "Use crops of the image itself as tiles instead of ./images")
+	selfImage := flag.String("self-image", "", "Use crops of this image as tiles instead of ./images")
+	selfScales := flag.String("self-scales", "2,3,4,6", "Crops per image edge for -self and -self-image, comma separated")
+	sprite := flag.String("sprite", "", "Use the sprites of this sprite sheet as tiles instead of ./images")
+	spriteCell := flag.String("sprite-cell", "", "Sprite sheet cell size, WxH or a single number for square cells")
+	spriteAtlas := flag.String("sprite-atlas", "", "Json atlas describing the sprites of the -sprite sheet")
+	archives := flag.String("archive", "", "Use the photos in these .zip, .tar or .tar.gz archives (comma separated) as tiles instead of ./images")
+	gifs := flag.String("gif", "", "Use every frame of these animated gifs (comma separated) as tiles instead of ./images")
+	synth := flag.String("synth", "", "Generate tiles from the palette instead of ./images, comma separated: solid, gradient, noise")
+	paletteColours := flag.String("palette", pico8Palette, "Comma separated #rrggbb colours of the -synth tiles")
+	synthSize := flag.Int("synth-size", 64, "Size of the -synth tiles in pixels")
+	grid := flag.String("grid", "rect", "Grid layout of the tiles: rect, hex, brick, herringbone, quadtree or voronoi")
+	hex := flag.String("hex", "pointy", "Hexagon orientation of the hex grid: pointy or flat")
+	variance := flag.Float64("variance", 400, "Colour variance above which quadtree grid cells are split")
+	minTile := flag.Int("min-tile", 8, "Smallest tile size of the quadtree grid in pixels")
+	seeds := flag.String("seeds", "poisson", "Seed points of the voronoi grid: random, poisson or edge")
+	voronoiCells := flag.Int("cells", 0, "Number of voronoi grid cells (default: number of tiles of the rect grid)")
+	shapeKind := flag.String("shape", "square", "Shape of the tiles drawn in the cells: square, circle or rounded")
+	shapeMask := flag.String("shape-mask", "", "Image whose shape (white or opaque pixels) the tiles are drawn in")
+	background := flag.String("background", "#000000", "Colour around the tile shapes")
+	gap := flag.Int("gap", 0, "Width of the grout lines between the tiles in pixels")
+	gapColour := flag.String("gap-colour", "#808080", "Colour of the grout lines")
+	bevel := flag.Int("bevel", 0, "Width of the bevelled tile edges in pixels")
+	shadow := flag.Int("shadow", 0, "Offset of the shadow cast by the tiles into the grout in pixels")
+	regionsFile := flag.String("mask", "", "Mask image whose colours select the tile library of each region")
+	workers := flag.Int("workers", runtime.GOMAXPROCS(0), "Number of goroutines processing the tiles and the mosaic cells")
+	maskLibraries := flag.String("mask-library", "", "Tile libraries (directories or archives) of the -mask colours, e.g. #ff0000=./team,#000000=./landscapes")
+	timeout := flag.Duration("timeout", 0, "Stop processing after this time, e.g. 30s or 2m (default: no limit)")
+	strict := flag.Bool("strict", false, "Fail on any tile that cannot be read or decoded instead of skipping it")
+	memoryBudget := flag.String("max-memory", "", "Memory budget, e.g. 512MB: render and write the mosaic as png band by band (default: whole image as jpeg)")
+	cacheDir := flag.String("cache", "", "Directory keeping pre-scaled tiles (16 to 128 px) and their colours between runs")
+	filterName := flag.String("filter", "auto", "Filter scaling the tiles and the output: nearest, bilinear, bicubic, lanczos2, lanczos3, area or auto (area for heavy downscaling, lanczos3 otherwise)")
+	outputScale := flag.Float64("scale", 1, "Scale the finished mosaic by this factor before saving it")
+	tileLRU := flag.Int("tile-lru", 0, "Load only the tiles placed in the mosaic, keeping this many of them in memory (default: keep all tiles)")
+	profiles := profileFlags()
 
 	flag.Parse()
 
-	fmt.Println(*imageFile, *tilesCount)
+	if *workers <= 0 {
+		return fmt.Errorf("workers=%d\n\tmust be > 0", *workers)
+	}
+
+	if *tileLRU < 0 {
+		return fmt.Errorf("tile-lru=%d\n\tmust be >= 0", *tileLRU)
+	}
 
-	// prepare the tiles
-	tileFiles, err := ioutil.ReadDir("./images")
+	maxMemory, err := parseBytes(*memoryBudget)
+	if *memoryBudget != "" && (err != nil || maxMemory == 0) {
+		return fmt.Errorf("max-memory=%q\n\tmust be a size > 0, e.g. 512MB or 2GB", *memoryBudget)
+	}
+
+	var tileCount, cellCount int
+
+	times, stopProfiling, err := profiles.start("channels", *workers, &tileCount, &cellCount)
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
+	// all stages stop when the processing is cancelled, by -timeout or
+	// by an interrupt (a second interrupt kills the program right away)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *timeout)
+		defer cancelTimeout()
+	}
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		fmt.Println("--> interrupted, stopping ...")
+		cancel()
+	}()
+
+	filter, err := parseFilter(*filterName)
+	if err != nil {
+		return err
+	}
+
+	if *outputScale <= 0 || *outputScale != 1 && maxMemory > 0 {
+		return fmt.Errorf("scale=%v\n\tmust be > 0, and 1 with -max-memory", *outputScale)
+	}
+
+	variants, err := tileVariants(*augment)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
+	shape, err := newCellShape(*shapeKind, *shapeMask)
+	if err != nil {
+		return err
+	}
+
+	backgroundColour, err := parseColour(*background)
+	if err != nil {
+		return err
+	}
+
+	groutColour, err := parseColour(*gapColour)
+	if err != nil {
+		return err
+	}
+
+	style := &cellStyle{
+		shape:      shape,
+		background: backgroundColour,
+		gap:        *gap,
+		gapColour:  groutColour,
+		bevel:      *bevel,
+		shadow:     *shadow,
+		filter:     filter,
+	}
+
+	fmt.Println(*imageFile, *tilesCount)
+
 	var wg sync.WaitGroup
-	var mutex sync.Mutex
 
 	var imagePattern = regexp.MustCompile(`^.*\.(jpg|JPG|jpeg|JPEG)$`)
 
@@ -126,11 +281,14 @@ func main() {
 	// read the file
 	file, err := os.Open(*imageFile)
 	if err != nil {
-		log.Fatal("#### ", err)
+		return err
 	}
 
 	// encode into an image
 	origImage, err := jpeg.Decode(bufio.NewReader(file))
+	if err != nil {
+		return decodeError(*imageFile, err)
+	}
 	//fmt.Printf("orig image %v: \n", origImage.At(origImage.Bounds().Min.X, origImage.Bounds().Min.Y))
 
 	xMin := origImage.Bounds().Min.X
@@ -142,65 +300,216 @@ func main() {
 	yDelta := int((yMax - yMin) / (*tilesCount))
 
 	if xDelta <= 0 || yDelta <= 0 {
-		log.Fatalf("\nERROR: xDelta=%d, yDelta=%d\n\tmust be > 0\n\n", xDelta, yDelta)
+		return fmt.Errorf("xDelta=%d, yDelta=%d\n\tmust be > 0", xDelta, yDelta)
 	}
 
 	fmt.Printf("--> xMin=%v, xMax=%v, xDelta=%v\n\n", xMin, xMax, xDelta)
 	fmt.Printf("--> yMin=%v, yMax=%v, yDelta=%v\n\n", yMin, yMax, yDelta)
 
-	tileData := make(chan tileMessage, len(tileFiles))
+	if *voronoiCells == 0 {
+		*voronoiCells = *tilesCount * *tilesCount
+	}
 
-	tStart := time.Now()
+	// the cells of the other grids barely overlap, their pixels are read
+	// about once, directly. The quadtree samples every pixel on each
+	// split level, it gets a summed-area table for constant time cell
+	// colours, unless a -max-memory budget is set.
+	var sampler colourSampler = directSampler{origImage}
+	if *grid == "quadtree" && maxMemory == 0 {
+		integral, err := newIntegralImage(ctx, origImage)
+		if err != nil {
+			return fmt.Errorf("mosaic processing stopped: %v", err)
+		}
+		sampler = integral
+	}
 
-	// loop through files
-	// goroutine to process each file
-	//		create TileImage struct to hold tile data
-	//		find average pixel values
-	//		send to channel
-	for _, fileTile := range tileFiles {
-		filename := fileTile.Name()
+	// lay out the cells of the mosaic, tiles are scaled to the cell size
+	cells, err := gridCells(ctx, origImage, sampler, xDelta, yDelta, gridOptions{
+		grid:     *grid,
+		hex:      *hex,
+		variance: *variance,
+		minTile:  *minTile,
+		seeds:    *seeds,
+		cells:    *voronoiCells,
+	})
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("mosaic processing stopped: %v", err)
+	}
+	if err != nil {
+		return err
+	}
+	cellCount = len(cells)
 
-		//fmt.Printf("\t\t==> i=%d - tile=%s\n", i, fileTile.Name())
+	// the grout is taken from the cells, the image keeps its size
+	tileWidth, tileHeight := cellsSize(cells)
+	tileWidth, tileHeight = tileWidth-style.gap, tileHeight-style.gap
+
+	if tileWidth <= 0 || tileHeight <= 0 {
+		return fmt.Errorf("gap=%d leaves no room for the tiles", style.gap)
+	}
+
+	// tile sources, the ./images directory unless another source is given
+	var sources []tileSource
+
+	if *self || *selfImage != "" {
+		scales, err := parseInts(*selfScales)
+		if err != nil {
+			return err
+		}
+
+		if *self {
+			sources = append(sources, selfTiles(*imageFile, origImage, scales))
+		}
+
+		if *selfImage != "" {
+			sourceImage, err := decodeImage(*selfImage)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, selfTiles(*selfImage, sourceImage, scales))
+		}
+	}
+
+	if *sprite != "" {
+		sheet, err := decodeImage(*sprite)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case *spriteAtlas != "":
+			sources = append(sources, atlasTiles(*sprite, sheet, *spriteAtlas))
+		case *spriteCell != "":
+			cellWidth, cellHeight, err := parseSize(*spriteCell)
+			if err != nil {
+				return err
+			}
+			sources = append(sources, spriteTiles(*sprite, sheet, cellWidth, cellHeight))
+		default:
+			return errors.New("-sprite needs either -sprite-cell or -sprite-atlas")
+		}
+	}
+
+	for _, archive := range strings.Split(*archives, ",") {
+		if archive != "" {
+			sources = append(sources, archiveTiles(archive, imagePattern))
+		}
+	}
 
-		if !imagePattern.MatchString(filename) {
-			continue
+	for _, gifFile := range strings.Split(*gifs, ",") {
+		if gifFile != "" {
+			sources = append(sources, gifTiles(gifFile))
 		}
+	}
 
-		file, err := os.Open(imageDir + filename)
+	if *synth != "" {
+		palette, err := parsePalette(*paletteColours)
 		if err != nil {
-			continue
+			return err
 		}
+		sources = append(sources, synthTiles(*synth, palette, *synthSize))
+	}
+
+	if len(sources) == 0 {
+		sources = append(sources, dirTiles(imageDir, imagePattern))
+	}
 
-		// encode into an image
-		tileImage, err := jpeg.Decode(bufio.NewReader(file))
+	// tile libraries of the -mask regions
+	var regions *regionMask
+
+	if *regionsFile != "" {
+		regions, err = newRegionMask(*regionsFile, *maskLibraries, origImage.Bounds())
 		if err != nil {
-			continue
+			return err
 		}
+	}
 
-		wg.Add(1)
+	// pre-scaled tiles of earlier runs, they are only large enough for
+	// tiles up to the largest mip size
+	var cache *tileCache
+
+	if *cacheDir != "" {
+		if mipsCover(tileWidth, tileHeight) {
+			cache, err = openTileCache(*cacheDir)
+			if err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("--> tiles of %dx%d are larger than the cached ones, not using the tile cache\n\n", tileWidth, tileHeight)
+		}
+	}
 
-		go func(wg *sync.WaitGroup, xDelta int, filename string, tileImage image.Image,
-			tileData chan tileMessage) {
-			getTileColour(wg, xDelta, filename, tileImage, tileData)
+	tStart := time.Now()
 
-		}(&wg, xDelta, filename, tileImage, tileData)
+	// tile sources of every library, the default tiles are the "" library
+	librarySources := map[string][]tileSource{"": sources}
+	libraries := []string{""}
 
+	if regions != nil {
+		for library, source := range regions.sources(imagePattern) {
+			librarySources[library] = []tileSource{source}
+			libraries = append(libraries, library)
+		}
 	}
 
-	wg.Wait()
+	// process the tiles in a pipeline of stages, each stage but the
+	// reading with its own workers
+	//		read the tile files of all sources
+	//		decode the tiles, create a tile for each variant
+	//		resize the tiles to the tile size
+	//		find average pixel values
+	//		index the tiles by library and filename
+	readTiles, readErr := readStage(ctx, librarySources, libraries, *workers, times)
+	// tiles that fail to read or decode are skipped and reported
+	tileErrors := &errorList{}
 
-	// close the channel after processing all the tiles
-	close(tileData)
+	decodedTiles := decodeStage(ctx, *workers, readTiles, variants, cache, *tileLRU > 0, filter, tileErrors, times)
+	resizedTiles := resizeStage(ctx, *workers, decodedTiles, tileWidth, tileHeight, filter, times)
+	tileData := signatureStage(ctx, *workers, resizedTiles, times)
 
-	// goroutine to create the mosaic
-	//		read data from tileFileData channel
-	//			lock to draw the tile
-	//
-	//
-	tiles := make(map[string]*TileImage)
+	tiles := make(map[string]map[string]*TileImage)
 
 	for m := range tileData {
-		tiles[m.filename] = m.tile
+		if tiles[m.library] == nil {
+			tiles[m.library] = make(map[string]*TileImage)
+		}
+		tiles[m.library][m.filename] = m.tile
+	}
+
+	if err := <-readErr; err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("tile processing stopped: %v", err)
+	}
+
+	if cache != nil {
+		if err := cache.save(ctx); err != nil {
+			fmt.Printf("--> tile cache: %v\n", err)
+		}
+	}
+
+	// -mask regions of an empty library fall back to the default tiles
+	for _, library := range libraries[1:] {
+		if len(tiles[library]) == 0 {
+			tileErrors.add(&imageError{name: library, kind: ErrEmptyLibrary})
+		}
+	}
+
+	if tileErrors.len() > 0 {
+		if *strict {
+			return fmt.Errorf("-strict: %s", strings.TrimSuffix(tileErrors.summary(20), "\n"))
+		}
+		fmt.Printf("--> %s\n", tileErrors.summary(10))
+	}
+
+	for _, libraryTiles := range tiles {
+		tileCount += len(libraryTiles)
+	}
+
+	if len(tiles[""]) == 0 {
+		return &imageError{name: "default tiles", kind: ErrEmptyLibrary}
 	}
 
 	//fmt.Printf("Tiles: %+v\n", tiles)
@@ -213,67 +522,161 @@ func main() {
 
 	tStart = time.Now()
 
-	// change into a mosaic
-	//		create a new empty image of the same size as the original one
-	//		on which the tiles will be placed
-	newImage := image.NewRGBA(image.Rect(xMin, yMin, xMax, yMax))
-
-	// loop along x and y axes of the original one:
+	// loop through the cells of the grid, the same number of workers
 	// find the tile that is nearestFilename in colour
-	for y := yMin; y <= yMax; y += yDelta {
-		for x := xMin; x <= xMax; x += xDelta {
+	matches := make([]*TileImage, len(cells))
+	cellJobs := make(chan int, *workers)
+
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
 
-			wg.Add(1)
+			// the time spent matching, without waiting for cells
+			start, busy := time.Now(), time.Duration(0)
+			defer func() { times.record("match", start, busy) }()
+
+			for i := range cellJobs {
+				if ctx.Err() != nil {
+					continue
+				}
 
-			go func(x int, y int) {
-				// find the average pixel colour of top left corner of each subimage
-				//rOrig, gOrig, bOrig, _ := origImage.At(x, y).RGBA()
-				origRGB := getImageColour(origImage, x, y, x+xDelta, y+yDelta)
+				matchStart := time.Now()
+				c := cells[i]
+
+				// find the average pixel colour of each cell
+				var origRGB []float64
+				if c.mask == nil {
+					origRGB = sampler.average(c.bounds)
+				} else {
+					origRGB = getMaskedColour(origImage, c.bounds, c.mask)
+				}
+
+				// tiles of the cell's -mask region, the default tiles elsewhere
+				candidates := tiles[""]
+				if regions != nil {
+					if library := regions.library(c); len(tiles[library]) > 0 {
+						candidates = tiles[library]
+					}
+				}
 
 				var nearestFilename string
 				var tileVectorDiff float64
 				smallestDiff := 99999999.0
 
-				for file, tile := range tiles {
+				for file, tile := range candidates {
 
 					r, g, b := tile.averageRGB[0], tile.averageRGB[1], tile.averageRGB[2]
 
 					tileVectorDiff = math.Sqrt(math.Pow((origRGB[0]-r), 2) + math.Pow((origRGB[1]-g), 2) + math.Pow((origRGB[2]-b), 2))
 
-					if tileVectorDiff < smallestDiff {
+					// equally near tiles, e.g. rotated variants, are told
+					// apart by their id, not by the random map order
+					if tileVectorDiff < smallestDiff || tileVectorDiff == smallestDiff && file < nearestFilename {
 						smallestDiff = tileVectorDiff
 						nearestFilename = file
 					}
 
 				}
 
-				// draw the tile into the new image
-				mutex.Lock()
-				draw.Draw(newImage, image.Rectangle{image.Point{x, y}, image.Point{x + xDelta, y + yDelta}}, tiles[nearestFilename].scaled, image.Point{xMin, yMin}, draw.Src)
-				mutex.Unlock()
+				// every worker writes its own cells' entries only
+				matches[i] = candidates[nearestFilename]
+				busy += time.Since(matchStart)
+			}
+		}()
+	}
 
-				wg.Done()
-			}(x, y)
+	for i := range cells {
+		if ctx.Err() != nil {
+			break
 		}
+		cellJobs <- i
 	}
 
+	close(cellJobs)
+
 	wg.Wait()
 
-	tEnd = time.Now()
-	fmt.Printf("\t==> Mosaic processing took %v to run.\n", tEnd.Sub(tStart))
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("mosaic processing stopped: %v", err)
+	}
 
-	// save the new finished image
-	mosaicFile, err := os.Create("mosaic.jpg")
-	if err != nil {
-		log.Fatal(err)
+	placements := make([]placement, len(cells))
+	for i, c := range cells {
+		placements[i] = placement{x: c.bounds.Min.X, y: c.bounds.Min.Y, tile: matches[i]}
 	}
-	defer mosaicFile.Close()
 
-	var opt jpeg.Options
-	opt.Quality = 80
+	// change into a mosaic
+	//		create a new empty image of the same size as the original one
+	//		on which the tiles will be placed
+	//		or, with a -max-memory budget, render and encode one band of
+	//		rows at a time, streaming the bands out as png
+	// a cancelled or failed save leaves no partial file behind
+	mosaicBounds := image.Rect(xMin, yMin, xMax, yMax)
+
+	// with -tile-lru only the matched tiles are loaded, while drawing
+	scaled := newScaledTiles(*tileLRU)
 
-	jpeg.Encode(mosaicFile, newImage, &opt)
+	if maxMemory > 0 {
+		bandHeight, err := bandRows(maxMemory, mosaicBounds.Dx())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("--> rendering bands of %d rows\n\n", bandHeight)
+
+		err = writeOutput(ctx, "mosaic.png", func(w io.Writer) error {
+			return renderBands(ctx, w, mosaicBounds, bandHeight, cells, matches, scaled, style, *workers, times)
+		})
+		if err != nil {
+			return fmt.Errorf("mosaic processing stopped: %v", err)
+		}
+	} else {
+		newImage := image.NewRGBA(mosaicBounds)
+
+		if err := drawCells(ctx, newImage, cells, matches, scaled, style, *workers, times); err != nil {
+			return fmt.Errorf("mosaic processing stopped: %v", err)
+		}
+
+		var mosaic image.Image = newImage
+		if *outputScale != 1 {
+			start := time.Now()
+			width := maxInt(int(math.Round(float64(mosaicBounds.Dx())**outputScale)), 1)
+			height := maxInt(int(math.Round(float64(mosaicBounds.Dy())**outputScale)), 1)
+			mosaic = filter.resize(newImage, width, height)
+			times.since("draw", start)
+		}
+
+		start := time.Now()
+		err = writeOutput(ctx, "mosaic.jpg", func(w io.Writer) error {
+			var opt jpeg.Options
+			opt.Quality = 80
+
+			return jpeg.Encode(w, mosaic, &opt)
+		})
+		times.since("encode", start)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *tileLRU > 0 {
+		fmt.Printf("--> loaded %d tiles for drawing\n", scaled.loaded())
+	}
+
+	tEnd = time.Now()
+	fmt.Printf("\t==> Mosaic processing took %v to run.\n", tEnd.Sub(tStart))
+
+	if *placementsFile != "" {
+		err := writeOutput(ctx, *placementsFile, func(w io.Writer) error {
+			return writePlacements(w, placements)
+		})
+		if err != nil {
+			return err
+		}
+	}
 
 	fmt.Println("END ...")
 
+	return nil
 }
@@ -7,16 +7,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"regexp"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,27 +39,34 @@ type TileImage struct {
 	cornerPixel  color.Color
 }
 
+// tiles that cannot be read or decoded are skipped, their errors added to errs
 func (tile *TileImage) getTileColours(mutex *sync.Mutex, imagePattern *regexp.Regexp,
 	imageDir string, filename string,
-	tiles map[string]*TileImage, tileImages map[string]color.Color) {
+	tiles map[string]*TileImage, tileImages map[string]color.Color, errs *errorList, times *stageTimes) {
 
 	if !imagePattern.MatchString(filename) {
 		return
 	}
 
-	file, err := os.Open(imageDir + filename)
+	start := time.Now()
+	data, err := ioutil.ReadFile(imageDir + filename)
+	times.since("load", start)
 	if err != nil {
-		log.Fatal(err)
+		errs.add(readError(filename, err))
+		return
 	}
-	defer file.Close()
 
 	// encode into an image
-	tileImage, err := jpeg.Decode(bufio.NewReader(file))
+	start = time.Now()
+	tileImage, err := jpeg.Decode(bytes.NewReader(data))
+	times.since("decode", start)
 	if err != nil {
-		//log.Printf(">>> %v", err)
+		errs.add(decodeError(filename, err))
 		return
 	}
 
+	start = time.Now()
+
 	xMin := tileImage.Bounds().Min.X
 	xMax := tileImage.Bounds().Max.X
 	yMin := tileImage.Bounds().Min.Y
@@ -61,8 +74,8 @@ func (tile *TileImage) getTileColours(mutex *sync.Mutex, imagePattern *regexp.Re
 
 	var rSum, gSum, bSum uint32 = 0, 0, 0
 
-	for y := yMin; y <= yMax; y++ {
-		for x := xMin; x <= xMax; x++ {
+	for y := yMin; y < yMax; y++ {
+		for x := xMin; x < xMax; x++ {
 
 			r, g, b, _ := tileImage.At(x, y).RGBA()
 			rSum += r
@@ -78,6 +91,7 @@ func (tile *TileImage) getTileColours(mutex *sync.Mutex, imagePattern *regexp.Re
 
 	tile.averagePixel = color.RGBA{uint8(rAvr), uint8(gAvr), uint8(bAvr), 255}
 	tile.cornerPixel = tileImage.At(tileImage.Bounds().Min.X, tileImage.Bounds().Min.Y)
+	times.since("signature", start)
 
 	mutex.Lock()
 	tileImages[filename] = tile.cornerPixel
@@ -93,28 +107,53 @@ func (tile *TileImage) getTileColours(mutex *sync.Mutex, imagePattern *regexp.Re
 
 func main() {
 
+	if err := run(); err != nil {
+		log.Fatalf("\nERROR: %v\n\n", err)
+	}
+}
+
+func run() error {
+
 	imageDir := "./images/"
 
 	// get cli arguments
 	//		get the image path from the cli ... -i
 	//		get number of tiles in a row ...... -t
+	//		get number of workers ............. -workers
+	//		get failing on bad tiles .......... -strict
+	//		get profiles and stage timings .... -cpuprofile, -memprofile, -trace, -timings
 	imageFile := flag.String("i", "origImage.jpg", "Image path")
 	tilesCount := flag.Int("t", 10, "Number of tiles along the image edge")
+	strict := flag.Bool("strict", false, "Fail on any tile that cannot be read or decoded instead of skipping it")
+	workers := flag.Int("workers", runtime.GOMAXPROCS(0), "Number of goroutines processing the tiles")
+	profiles := profileFlags()
 
 	flag.Parse()
 
+	if *workers <= 0 {
+		return fmt.Errorf("workers=%d\n\tmust be > 0", *workers)
+	}
+
+	var tileCount, cellCount int
+
+	times, stopProfiling, err := profiles.start("conc", *workers, &tileCount, &cellCount)
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
 	fmt.Println(*imageFile, *tilesCount)
 
 	// prepare the tiles
 	dir, err := os.Open(imageDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer dir.Close()
 
 	tileFiles, err := dir.Readdir(-1)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	var wg sync.WaitGroup
@@ -125,26 +164,54 @@ func main() {
 	tiles := make(map[string]*TileImage)
 	tileImages := make(map[string]color.Color)
 
-	tStart := time.Now()
+	// tiles that fail to read or decode are skipped and reported
+	tileErrors := &errorList{}
 
-	for _, tile := range tileFiles {
+	tStart := time.Now()
 
-		//fmt.Printf("\t\t==> i=%v - tile=%s\n", i, tile.Name())
+	// a fixed number of workers decodes the tiles, the loop below blocks
+	// while they are all busy, so only that many tiles are in memory
+	tileJobs := make(chan os.FileInfo, *workers)
 
+	for i := 0; i < *workers; i++ {
 		wg.Add(1)
-		go func(tile os.FileInfo) {
+		go func() {
 			defer wg.Done()
 
-			filename := tile.Name()
+			for tile := range tileJobs {
+				filename := tile.Name()
+
+				thisTile := &TileImage{}
+
+				thisTile.getTileColours(&mutex, imagePattern, imageDir, filename, tiles, tileImages, tileErrors, times)
+			}
+		}()
+	}
+
+	for _, tile := range tileFiles {
 
-			thisTile := &TileImage{}
+		//fmt.Printf("\t\t==> i=%v - tile=%s\n", i, tile.Name())
 
-			thisTile.getTileColours(&mutex, imagePattern, imageDir, filename, tiles, tileImages)
-		}(tile)
+		tileJobs <- tile
 	}
 
+	close(tileJobs)
+
 	wg.Wait()
 
+	if tileErrors.len() > 0 {
+		if *strict {
+			return fmt.Errorf("-strict: %s", strings.TrimSuffix(tileErrors.summary(20), "\n"))
+		}
+		fmt.Printf("--> %s\n", tileErrors.summary(10))
+	}
+
+	tileCount = len(tileImages)
+
+	if len(tileImages) == 0 {
+		return &imageError{name: imageDir, kind: ErrEmptyLibrary}
+	}
+
 	/*
 		fmt.Printf("number of files : %d: \n", len(tileFiles))
 		fmt.Printf("number of tiles : %d: \n", len(tiles))
@@ -160,12 +227,15 @@ func main() {
 	// read the file
 	file, err := os.Open(*imageFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
 	// encode into an image
 	origImage, err := jpeg.Decode(bufio.NewReader(file))
+	if err != nil {
+		return decodeError(*imageFile, err)
+	}
 	fmt.Printf("orig image %v: \n", origImage.At(origImage.Bounds().Min.X, origImage.Bounds().Min.Y))
 
 	xMin := origImage.Bounds().Min.X
@@ -176,6 +246,12 @@ func main() {
 	xDelta := int((xMax - xMin) / (*tilesCount))
 	yDelta := int((yMax - yMin) / (*tilesCount))
 
+	if xDelta <= 0 || yDelta <= 0 {
+		return fmt.Errorf("xDelta=%d, yDelta=%d\n\tmust be > 0", xDelta, yDelta)
+	}
+
+	cellCount = ((xMax-xMin)/xDelta + 1) * ((yMax-yMin)/yDelta + 1)
+
 	fmt.Printf("--> xMin=%v, xMax=%v, xDelta=%v\n\n", xMin, xMax, xDelta)
 	fmt.Printf("--> yMin=%v, yMax=%v, yDelta=%v\n\n", yMin, yMax, yDelta)
 
@@ -190,11 +266,15 @@ func main() {
 	//		on which the tiles will be placed
 	newImage := image.NewRGBA(image.Rect(xMin, yMin, xMax, yMax))
 
+	drawErrors := &errorList{}
+
 	// loop along x and y axes of the original one:
 	// find the tile that is nearestTile in colour
 	for y := yMin; y <= yMax; y += yDelta {
 		for x := xMin; x <= xMax; x += xDelta {
 
+			matchStart := time.Now()
+
 			// find the average pixel colour of top left corner of each subimage
 			rOrig, gOrig, bOrig, _ := origImage.At(x, y).RGBA()
 
@@ -216,40 +296,57 @@ func main() {
 			}
 
 			//fmt.Printf("--> x=%v, y=%v, tileVectorDiff=%v, nearestTile=%v\n", x, y, tileVectorDiff, nearestTile)
+			times.since("match", matchStart)
 
-			// read the file
-
-			file, err := os.Open(imageDir + nearestTile)
+			// read the file, a tile that cannot be read again
+			// leaves its cell empty and is reported at the end
+			start := time.Now()
+			data, err := ioutil.ReadFile(imageDir + nearestTile)
+			times.since("load", start)
 			if err != nil {
-				log.Fatal(err)
+				drawErrors.add(readError(nearestTile, err))
+				continue
 			}
 
 			// resize the tile and draw it on the new image
-			tileImage, err := jpeg.Decode(bufio.NewReader(file))
+			start = time.Now()
+			tileImage, err := jpeg.Decode(bytes.NewReader(data))
+			times.since("decode", start)
+			if err != nil {
+				drawErrors.add(decodeError(nearestTile, err))
+				continue
+			}
+
+			start = time.Now()
 			resizedTile := resize.Resize(uint(xDelta), 0, tileImage, resize.Lanczos3)
+			times.since("resize", start)
+
+			start = time.Now()
 
 			//subImage := image.NewAlpha16(newImage.Bounds()).SubImage(image.Rect(x, y, x+xDelta, y+yDelta))
 			// draw the tile into the new image
 			draw.Draw(newImage, image.Rectangle{image.Point{x, y}, image.Point{x + xDelta, y + yDelta}}, resizedTile, image.Point{resizedTile.Bounds().Min.X, resizedTile.Bounds().Min.Y}, draw.Src)
 			//fmt.Printf(">>> drawing at [%v, %v] : %v\n\n", x, y, nearestTile)
-
-			file.Close()
+			times.since("draw", start)
 		}
 	}
 
+	if drawErrors.len() > 0 {
+		fmt.Printf("--> cells left empty: %s\n", drawErrors.summary(10))
+	}
+
 	tEnd = time.Now()
 	fmt.Printf("\t==> Mosaic processing took %v to run.\n", tEnd.Sub(tStart))
 
-	// save the new finished image
-	mosaicFile, err := os.Create("mosaic.jpg")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer mosaicFile.Close()
-
-	// write new image to file
+	// save the new finished image, a failed encode leaves no partial
+	// mosaic.jpg behind
+	start := time.Now()
 	var opt jpeg.Options
 	opt.Quality = 80
-	jpeg.Encode(mosaicFile, newImage, &opt)
+	err = writeOutput(context.Background(), "mosaic.jpg", func(w io.Writer) error {
+		return jpeg.Encode(w, newImage, &opt)
+	})
+	times.since("encode", start)
 
+	return err
 }
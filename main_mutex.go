@@ -7,17 +7,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"regexp"
+	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,59 +41,51 @@ type TileImage struct {
 	cornerPixel color.Color
 }
 
-// calculates tile photo colour
+// calculates tile photo colour, tiles that cannot be read or decoded
+// are skipped, their errors added to errs
 func (tile *TileImage) getTileColour(mutex *sync.Mutex, imagePattern *regexp.Regexp,
 	xDelta int, imageDir string, filename string,
-	tiles map[string]*TileImage, tileImages map[string]color.Color) {
+	tiles map[string]*TileImage, tileImages map[string]color.Color, errs *errorList, times *stageTimes) {
 
 	if !imagePattern.MatchString(filename) {
 		return
 	}
 
-	file, err := os.Open(imageDir + filename)
+	start := time.Now()
+	data, err := ioutil.ReadFile(imageDir + filename)
+	times.since("load", start)
 	if err != nil {
-		log.Fatal(err)
+		errs.add(readError(filename, err))
+		return
 	}
-	defer file.Close()
 
 	// encode into an image
-	tileImage, err := jpeg.Decode(bufio.NewReader(file))
+	start = time.Now()
+	tileImage, err := jpeg.Decode(bytes.NewReader(data))
+	times.since("decode", start)
 	if err != nil {
-		//log.Printf(">>> %v", err)
+		errs.add(decodeError(filename, err))
 		return
 	}
 
 	tile.xMin = tileImage.Bounds().Min.X
 	tile.yMin = tileImage.Bounds().Min.Y
 
+	start = time.Now()
 	resizedTile := resize.Resize(uint(xDelta), 0, tileImage, resize.Lanczos3)
+	times.since("resize", start)
+
+	start = time.Now()
 
 	xMin := resizedTile.Bounds().Min.X
 	xMax := resizedTile.Bounds().Max.X
 	yMin := resizedTile.Bounds().Min.Y
 	yMax := resizedTile.Bounds().Max.Y
 
-	var rSum, gSum, bSum float64 = 0, 0, 0
-
-	for y := yMin; y <= yMax; y++ {
-		for x := xMin; x <= xMax; x++ {
-
-			r, g, b, _ := tileImage.At(x, y).RGBA()
-			rSum += float64(r)
-			gSum += float64(g)
-			bSum += float64(b)
-		}
-	}
-
-	pixelCount := uint32((xMax - xMin) * (yMax - yMin))
-	rAvr := rSum / float64(pixelCount)
-	gAvr := gSum / float64(pixelCount)
-	bAvr := bSum / float64(pixelCount)
-
-	averageRGB := []float64{rAvr, gAvr, bAvr}
-
-	tile.averageRGB = averageRGB
+	// the average colour of the resized tile, as drawn
+	tile.averageRGB = getImageColour(resizedTile, xMin, yMin, xMax, yMax)
 	tile.scaled = resizedTile
+	times.since("signature", start)
 
 	mutex.Lock()
 	tileImages[filename] = tile.cornerPixel
@@ -102,8 +99,8 @@ func getImageColour(image image.Image, xMin, yMin, xMax, yMax int) []float64 {
 
 	var rSum, gSum, bSum float64 = 0.0, 0.0, 0.0
 
-	for y := yMin; y <= yMax; y++ {
-		for x := xMin; x <= xMax; x++ {
+	for y := yMin; y < yMax; y++ {
+		for x := xMin; x < xMax; x++ {
 
 			r, g, b, _ := image.At(x, y).RGBA()
 			rSum += float64(r)
@@ -122,22 +119,125 @@ func getImageColour(image image.Image, xMin, yMin, xMax, yMax int) []float64 {
 	return averageRGB
 }
 
+// drawMosaic matches and draws the tiles into newImage on the given
+// number of workers, a row of cells at a time: each worker draws into
+// its own row band of the new image, the bands never overlap, so no
+// lock is needed
+func drawMosaic(newImage *image.RGBA, origImage image.Image, tiles map[string]*TileImage, xDelta, yDelta, workers int,
+	times *stageTimes) {
+
+	var wg sync.WaitGroup
+
+	bounds := newImage.Bounds()
+	xMin, xMax := bounds.Min.X, bounds.Max.X
+	yMin, yMax := bounds.Min.Y, bounds.Max.Y
+
+	rowJobs := make(chan int, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// the time spent matching and drawing, without waiting for rows
+			start := time.Now()
+			var matchBusy, drawBusy time.Duration
+			defer func() {
+				times.record("match", start, matchBusy)
+				times.record("draw", start, drawBusy)
+			}()
+
+			for y := range rowJobs {
+				band := newImage.SubImage(image.Rect(xMin, y, xMax, y+yDelta)).(*image.RGBA)
+
+				for x := xMin; x <= xMax; x += xDelta {
+
+					matchStart := time.Now()
+					origRGB := getImageColour(origImage, x, y, x+xDelta, y+yDelta)
+
+					var nearestFilename string
+					var tileVectorDiff float64
+					smallestDiff := 99999999.0
+
+					for file, tile := range tiles {
+
+						r, g, b := tile.averageRGB[0], tile.averageRGB[1], tile.averageRGB[2]
+
+						tileVectorDiff = math.Sqrt(math.Pow((origRGB[0]-r), 2) + math.Pow((origRGB[1]-g), 2) + math.Pow((origRGB[2]-b), 2))
+
+						// equally near tiles are told apart by their
+						// name, not by the random map order
+						if tileVectorDiff < smallestDiff || tileVectorDiff == smallestDiff && file < nearestFilename {
+							smallestDiff = tileVectorDiff
+							nearestFilename = file
+						}
+
+					}
+
+					// read the file
+					scaledTile := tiles[nearestFilename].scaled
+					xMin, yMin := tiles[nearestFilename].xMin, tiles[nearestFilename].yMin
+
+					drawStart := time.Now()
+					matchBusy += drawStart.Sub(matchStart)
+
+					// draw the tile into the worker's band of the new image
+					draw.Draw(band, image.Rectangle{image.Point{x, y}, image.Point{x + xDelta, y + yDelta}}, scaledTile, image.Point{xMin, yMin}, draw.Src)
+					drawBusy += time.Since(drawStart)
+				}
+			}
+		}()
+	}
+
+	// loop along the y axis of the original one:
+	// find the tiles that are nearestFilename in colour, row by row
+	for y := yMin; y <= yMax; y += yDelta {
+		rowJobs <- y
+	}
+
+	close(rowJobs)
+
+	wg.Wait()
+}
+
 func main() {
 
+	if err := run(); err != nil {
+		log.Fatalf("\nERROR: %v\n\n", err)
+	}
+}
+
+func run() error {
+
 	imageDir := "./images/"
 
 	// get cli arguments
 	imageFile := flag.String("i", "origImage.jpg", "Image path")
 	tilesCount := flag.Int("t", 10, "Number of tiles along the image edge")
+	strict := flag.Bool("strict", false, "Fail on any tile that cannot be read or decoded instead of skipping it")
+	workers := flag.Int("workers", runtime.GOMAXPROCS(0), "Number of goroutines processing the tiles and the mosaic")
+	profiles := profileFlags()
 
 	flag.Parse()
 
+	if *workers <= 0 {
+		return fmt.Errorf("workers=%d\n\tmust be > 0", *workers)
+	}
+
+	var tileCount, cellCount int
+
+	times, stopProfiling, err := profiles.start("mutex", *workers, &tileCount, &cellCount)
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
 	fmt.Println(*imageFile, *tilesCount)
 
 	// prepare the tiles
 	tileFiles, err := ioutil.ReadDir("./images")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	var wg sync.WaitGroup
@@ -151,12 +251,15 @@ func main() {
 	// read the file
 	file, err := os.Open(*imageFile)
 	if err != nil {
-		log.Fatal("#### ", err)
+		return err
 	}
 	defer file.Close()
 
 	// encode into an image
 	origImage, err := jpeg.Decode(bufio.NewReader(file))
+	if err != nil {
+		return decodeError(*imageFile, err)
+	}
 	fmt.Printf("orig image %v: \n", origImage.At(origImage.Bounds().Min.X, origImage.Bounds().Min.Y))
 
 	xMin := origImage.Bounds().Min.X
@@ -168,30 +271,60 @@ func main() {
 	yDelta := int((yMax - yMin) / (*tilesCount))
 
 	if xDelta <= 0 || yDelta <= 0 {
-		log.Fatalf("\nERROR: xDelta=%d, yDelta=%d\n\tmust be > 0\n\n", xDelta, yDelta)
+		return fmt.Errorf("xDelta=%d, yDelta=%d\n\tmust be > 0", xDelta, yDelta)
 	}
 
+	cellCount = ((xMax-xMin)/xDelta + 1) * ((yMax-yMin)/yDelta + 1)
+
 	fmt.Printf("--> xMin=%v, xMax=%v, xDelta=%v\n\n", xMin, xMax, xDelta)
 	fmt.Printf("--> yMin=%v, yMax=%v, yDelta=%v\n\n", yMin, yMax, yDelta)
 
+	// tiles that fail to read or decode are skipped and reported
+	tileErrors := &errorList{}
+
 	tStart := time.Now()
 
-	for _, tile := range tileFiles {
+	// a fixed number of workers decodes and resizes the tiles, the loop
+	// below blocks while they are all busy, so only that many tiles are
+	// in memory at once
+	tileJobs := make(chan os.FileInfo, *workers)
 
+	for i := 0; i < *workers; i++ {
 		wg.Add(1)
-		go func(tile os.FileInfo) {
+		go func() {
 			defer wg.Done()
 
-			filename := tile.Name()
+			for tile := range tileJobs {
+				filename := tile.Name()
 
-			thisTile := &TileImage{}
+				thisTile := &TileImage{}
 
-			thisTile.getTileColour(&mutex, imagePattern, xDelta, imageDir, filename, tiles, tileImages)
-		}(tile)
+				thisTile.getTileColour(&mutex, imagePattern, xDelta, imageDir, filename, tiles, tileImages, tileErrors, times)
+			}
+		}()
+	}
+
+	for _, tile := range tileFiles {
+		tileJobs <- tile
 	}
 
+	close(tileJobs)
+
 	wg.Wait()
 
+	if tileErrors.len() > 0 {
+		if *strict {
+			return fmt.Errorf("-strict: %s", strings.TrimSuffix(tileErrors.summary(20), "\n"))
+		}
+		fmt.Printf("--> %s\n", tileErrors.summary(10))
+	}
+
+	tileCount = len(tiles)
+
+	if len(tiles) == 0 {
+		return &imageError{name: imageDir, kind: ErrEmptyLibrary}
+	}
+
 	tEnd := time.Now()
 	fmt.Printf("Tile processing took %v to run.\n", tEnd.Sub(tStart))
 
@@ -205,63 +338,25 @@ func main() {
 	//		on which the tiles will be placed
 	newImage := image.NewRGBA(image.Rect(xMin, yMin, xMax, yMax))
 
-	// loop along x and y axes of the original one:
-	// find the tile that is nearestFilename in colour
-	for y := yMin; y <= yMax; y += yDelta {
-		for x := xMin; x <= xMax; x += xDelta {
-
-			wg.Add(1)
-
-			go func(x int, y int) {
-				origRGB := getImageColour(origImage, x, y, x+xDelta, y+yDelta)
-
-				var nearestFilename string
-				var tileVectorDiff float64
-				smallestDiff := 99999999.0
-
-				for file, tile := range tiles {
-
-					r, g, b := tile.averageRGB[0], tile.averageRGB[1], tile.averageRGB[2]
-
-					tileVectorDiff = math.Sqrt(math.Pow((origRGB[0]-r), 2) + math.Pow((origRGB[1]-g), 2) + math.Pow((origRGB[2]-b), 2))
-
-					if tileVectorDiff < smallestDiff {
-						smallestDiff = tileVectorDiff
-						nearestFilename = file
-					}
-
-				}
-
-				// read the file
-				scaledTile := tiles[nearestFilename].scaled
-				xMin, yMin := tiles[nearestFilename].xMin, tiles[nearestFilename].yMin
-
-				// draw the tile into the new image
-				mutex.Lock()
-				draw.Draw(newImage, image.Rectangle{image.Point{x, y}, image.Point{x + xDelta, y + yDelta}}, scaledTile, image.Point{xMin, yMin}, draw.Src)
-				mutex.Unlock()
-
-				wg.Done()
-			}(x, y)
-		}
-	}
-
-	wg.Wait()
+	drawMosaic(newImage, origImage, tiles, xDelta, yDelta, *workers, times)
 
 	tEnd = time.Now()
 	fmt.Printf("Mosaic processing took %v to run.\n", tEnd.Sub(tStart))
 
-	// save the new finished image
-	mosaicFile, err := os.Create("mosaic.jpg")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer mosaicFile.Close()
-
+	// save the new finished image, a failed encode leaves no partial
+	// mosaic.jpg behind
+	start := time.Now()
 	var opt jpeg.Options
 	opt.Quality = 80
-	jpeg.Encode(mosaicFile, newImage, &opt)
+	err = writeOutput(context.Background(), "mosaic.jpg", func(w io.Writer) error {
+		return jpeg.Encode(w, newImage, &opt)
+	})
+	times.since("encode", start)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("END ...")
 
+	return nil
 }
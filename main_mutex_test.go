@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// drawMosaic draws the rows of cells on several workers, each into its
+// own band of the image; the mosaic must be the one a single worker
+// draws. Run with -race to check the workers share no pixels.
+func TestDrawMosaicWorkers(t *testing.T) {
+
+	// not a multiple of the cell size, the last row and column are cut
+	origImage := image.NewRGBA(image.Rect(0, 0, 103, 79))
+	for y := 0; y < 79; y++ {
+		for x := 0; x < 103; x++ {
+			origImage.SetRGBA(x, y, color.RGBA{uint8(2 * x), uint8(3 * y), uint8(x * y), 255})
+		}
+	}
+
+	xDelta, yDelta := 10, 7
+
+	// tiles are scaled to the cell width keeping their aspect ratio,
+	// taller ones reach into the rows below unless clipped
+	tiles := make(map[string]*TileImage)
+	for i := 0; i < 12; i++ {
+		scaled := image.NewRGBA(image.Rect(0, 0, xDelta, 2*yDelta))
+		for y := 0; y < 2*yDelta; y++ {
+			for x := 0; x < xDelta; x++ {
+				scaled.SetRGBA(x, y, color.RGBA{uint8(20 * i), uint8(25 * x), uint8(255 - 20*i), 255})
+			}
+		}
+
+		bounds := scaled.Bounds()
+		tiles[fmt.Sprintf("tile%d.jpg", i)] = &TileImage{
+			scaled:     scaled,
+			averageRGB: getImageColour(scaled, bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y),
+		}
+	}
+
+	var want *image.RGBA
+
+	for _, workers := range []int{1, 4, 9} {
+		newImage := image.NewRGBA(origImage.Bounds())
+		drawMosaic(newImage, origImage, tiles, xDelta, yDelta, workers, newStageTimes())
+
+		if want == nil {
+			want = newImage
+		} else if !bytes.Equal(newImage.Pix, want.Pix) {
+			t.Errorf("%d workers draw another mosaic than 1 worker", workers)
+		}
+	}
+}
@@ -5,17 +5,21 @@ package main
 
 import (
 	"bufio"
-	"errors"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/jpeg"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/nfnt/resize"
@@ -23,26 +27,45 @@ import (
 
 func main() {
 
+	if err := run(); err != nil {
+		log.Fatalf("\nERROR: %v\n\n", err)
+	}
+}
+
+func run() error {
+
 	imageDir := "./images/"
 
 	// get cli arguments
 	//		get the image path from the cli ... -i
 	//		get number of tiles in a row ...... -t
+	//		get failing on bad tiles .......... -strict
+	//		get profiles and stage timings .... -cpuprofile, -memprofile, -trace, -timings
 	imageFile := flag.String("i", "origImage.jpg", "Image path")
 	tilesCount := flag.Int("t", 10, "Number of tiles along the image edge")
+	strict := flag.Bool("strict", false, "Fail on any tile that cannot be read or decoded instead of skipping it")
+	profiles := profileFlags()
 
 	flag.Parse()
 
+	var tileCount, cellCount int
+
+	times, stopProfiling, err := profiles.start("nonconc", 1, &tileCount, &cellCount)
+	if err != nil {
+		return err
+	}
+	defer stopProfiling()
+
 	// prepare the tiles
 	dir, err := os.Open(imageDir)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer dir.Close()
 
 	tileFiles, err := dir.Readdir(-1)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	tStart := time.Now()
@@ -51,14 +74,36 @@ func main() {
 
 	tileImages := make(map[string]color.Color)
 
+	// tile files that cannot be read are skipped and reported
+	tileErrors := &errorList{}
+
 	for _, tile := range tileFiles {
 		filename := tile.Name()
 
-		pixelColour, err := getTileColours(imagePattern, imageDir, filename)
+		if !imagePattern.MatchString(filename) {
+			continue
+		}
 
-		if err == nil {
-			tileImages[filename] = pixelColour
+		pixelColour, err := getTileColours(imageDir, filename, times)
+		if err != nil {
+			tileErrors.add(err)
+			continue
 		}
+
+		tileImages[filename] = pixelColour
+	}
+
+	if tileErrors.len() > 0 {
+		if *strict {
+			return fmt.Errorf("-strict: %s", strings.TrimSuffix(tileErrors.summary(20), "\n"))
+		}
+		fmt.Printf("--> %s\n", tileErrors.summary(10))
+	}
+
+	tileCount = len(tileImages)
+
+	if len(tileImages) == 0 {
+		return &imageError{name: imageDir, kind: ErrEmptyLibrary}
 	}
 
 	tEnd := time.Now()
@@ -70,12 +115,15 @@ func main() {
 	// read the file
 	file, err := os.Open(*imageFile)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
 	// encode into an image
 	origImage, err := jpeg.Decode(bufio.NewReader(file))
+	if err != nil {
+		return decodeError(*imageFile, err)
+	}
 	//fmt.Printf("orig image %v: \n", origImage.At(origImage.Bounds().Min.X, origImage.Bounds().Min.Y))
 
 	xMin := origImage.Bounds().Min.X
@@ -86,11 +134,19 @@ func main() {
 	xDelta := int((xMax - xMin) / (*tilesCount))
 	yDelta := int((yMax - yMin) / (*tilesCount))
 
+	if xDelta <= 0 || yDelta <= 0 {
+		return fmt.Errorf("xDelta=%d, yDelta=%d\n\tmust be > 0", xDelta, yDelta)
+	}
+
+	cellCount = ((xMax-xMin)/xDelta + 1) * ((yMax-yMin)/yDelta + 1)
+
 	// change into a mosaic
 	//		create a new empty image of the same size as the original one
 	//		on which the tiles will be placed
 	newImage := image.NewRGBA(image.Rect(xMin, yMin, xMax, yMax))
 
+	drawErrors := &errorList{}
+
 	tStart = time.Now()
 	//		loop along x and y axes of the original one:
 
@@ -98,6 +154,8 @@ func main() {
 	for y := yMin; y <= yMax; y += yDelta {
 		for x := xMin; x <= xMax; x += xDelta {
 
+			matchStart := time.Now()
+
 			// find the average pixel colour of top left corner of each subimage
 			rOrig, gOrig, bOrig, _ := origImage.At(x, y).RGBA()
 
@@ -118,62 +176,82 @@ func main() {
 
 			}
 
-			// read the file
-			file, err := os.Open(imageDir + nearestTile)
+			times.since("match", matchStart)
+
+			// read the file, a tile that cannot be read again
+			// leaves its cell empty and is reported at the end
+			start := time.Now()
+			data, err := ioutil.ReadFile(imageDir + nearestTile)
+			times.since("load", start)
 			if err != nil {
-				log.Fatal(err)
+				drawErrors.add(readError(nearestTile, err))
+				continue
 			}
 
 			// resize the tile and draw it on the new image
-			tileImage, err := jpeg.Decode(bufio.NewReader(file))
+			start = time.Now()
+			tileImage, err := jpeg.Decode(bytes.NewReader(data))
+			times.since("decode", start)
+			if err != nil {
+				drawErrors.add(decodeError(nearestTile, err))
+				continue
+			}
+
+			start = time.Now()
 			resizedTile := resize.Resize(uint(xDelta), 0, tileImage, resize.Lanczos3)
+			times.since("resize", start)
+
+			start = time.Now()
 
 			// create a subImage (?)
 			//subImage := image.NewAlpha16(newImage.Bounds()).SubImage(image.Rect(x, y, x+xDelta, y+yDelta))
 			// draw the tile into the new image
 			draw.Draw(newImage, image.Rectangle{image.Point{x, y}, image.Point{x + xDelta, y + yDelta}}, resizedTile, image.Point{resizedTile.Bounds().Min.X, resizedTile.Bounds().Min.Y}, draw.Src)
-
-			file.Close()
+			times.since("draw", start)
 		}
 	}
 
+	if drawErrors.len() > 0 {
+		fmt.Printf("--> cells left empty: %s\n", drawErrors.summary(10))
+	}
+
 	tEnd = time.Now()
 	fmt.Printf("\t==> Mosaic processing took %v to run.\n", tEnd.Sub(tStart))
 
-	// save the new finished image
-	mosaicFile, err := os.Create("mosaic.jpg")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer mosaicFile.Close()
-
-	// write new image to file
+	// save the new finished image, a failed encode leaves no partial
+	// mosaic.jpg behind
+	start := time.Now()
 	var opt jpeg.Options
 	opt.Quality = 80
-	jpeg.Encode(mosaicFile, newImage, &opt)
+	err = writeOutput(context.Background(), "mosaic.jpg", func(w io.Writer) error {
+		return jpeg.Encode(w, newImage, &opt)
+	})
+	times.since("encode", start)
 
+	return err
 }
 
-//
-func getTileColours(imagePattern *regexp.Regexp, imageDir string, filename string) (color.Color, error) {
-
-	if !imagePattern.MatchString(filename) {
-		return nil, errors.New("Cannot get colour")
-	}
+// gets the colour of the tile's top left pixel
+func getTileColours(imageDir string, filename string, times *stageTimes) (color.Color, error) {
 
-	file, err := os.Open(imageDir + filename)
+	start := time.Now()
+	data, err := ioutil.ReadFile(imageDir + filename)
+	times.since("load", start)
 	if err != nil {
-		log.Fatal(err)
+		return nil, readError(filename, err)
 	}
-	defer file.Close()
 
 	// encode into an image
-	tileImage, err := jpeg.Decode(bufio.NewReader(file))
+	start = time.Now()
+	tileImage, err := jpeg.Decode(bytes.NewReader(data))
+	times.since("decode", start)
 	if err != nil {
-		return nil, err
+		return nil, decodeError(filename, err)
 	}
 
+	start = time.Now()
 	pixelColour := tileImage.At(tileImage.Bounds().Min.X, tileImage.Bounds().Min.Y)
+	times.since("signature", start)
 
 	return pixelColour, nil
 }
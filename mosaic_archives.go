@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// archiveTiles streams the tile photos out of a .zip, .tar, .tar.gz
+// or .tgz archive without unpacking it. Tiles are named archive!entry.
+// The entries are read here, decoded by the decode stage.
+func archiveTiles(archivePath string, imagePattern *regexp.Regexp) tileSource {
+	return func(emit emitTile) error {
+
+		kind, err := archiveType(archivePath)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case "zip":
+			return zipTiles(archivePath, imagePattern, emit)
+		case "tar":
+			return tarTiles(archivePath, false, imagePattern, emit)
+		}
+
+		return tarTiles(archivePath, true, imagePattern, emit)
+	}
+}
+
+// archiveType tells the archive type (zip, tar or tar.gz) by the file suffix
+func archiveType(archivePath string) (string, error) {
+
+	name := strings.ToLower(archivePath)
+
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(name, ".tar"):
+		return "tar", nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz", nil
+	}
+
+	return "", fmt.Errorf("%s: unknown archive type (use .zip, .tar, .tar.gz or .tgz)", archivePath)
+}
+
+func zipTiles(archivePath string, imagePattern *regexp.Regexp, emit emitTile) error {
+
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	for i, entry := range archive.File {
+		if entry.FileInfo().IsDir() || !imagePattern.MatchString(path.Base(entry.Name)) {
+			continue
+		}
+
+		name := archivePath + "!" + entry.Name
+
+		data, err := zipEntry(entry)
+
+		load := decoded(data)
+		load.reload = reread(name, zipEntryAt(archivePath, i))
+		if err != nil {
+			load = failed(readError(name, err))
+		}
+
+		if err := emit(name, load); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// zipEntry reads the entry for the decode stage
+func zipEntry(entry *zip.File) ([]byte, error) {
+
+	file, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+// zipEntryAt reads the i-th entry of the archive again, opening it
+func zipEntryAt(archivePath string, i int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+
+		archive, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer archive.Close()
+
+		if i >= len(archive.File) {
+			return nil, fmt.Errorf("%s: entry %d is gone", archivePath, i)
+		}
+
+		return zipEntry(archive.File[i])
+	}
+}
+
+func tarTiles(archivePath string, gzipped bool, imagePattern *regexp.Regexp, emit emitTile) error {
+
+	archive, closeArchive, err := openTar(archivePath, gzipped)
+	if err != nil {
+		return err
+	}
+	defer closeArchive()
+
+	for i := 0; ; i++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", archivePath, err)
+		}
+
+		if header.Typeflag != tar.TypeReg || !imagePattern.MatchString(path.Base(header.Name)) {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return fmt.Errorf("%s: %v", archivePath, err)
+		}
+
+		name := archivePath + "!" + header.Name
+
+		load := decoded(data)
+		load.reload = reread(name, tarEntryAt(archivePath, gzipped, i))
+
+		if err := emit(name, load); err != nil {
+			return err
+		}
+	}
+}
+
+// openTar opens the tar archive, gunzipping it if gzipped, closeArchive
+// closes its file
+func openTar(archivePath string, gzipped bool) (archive *tar.Reader, closeArchive func(), err error) {
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var reader io.Reader = bufio.NewReader(file)
+
+	if gzipped {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("%s: %v", archivePath, err)
+		}
+
+		reader = gzipReader
+	}
+
+	return tar.NewReader(reader), func() { file.Close() }, nil
+}
+
+// tarEntryAt reads the i-th entry of the archive again. Tar archives
+// cannot seek, the archive is read from its start up to the entry.
+func tarEntryAt(archivePath string, gzipped bool, i int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+
+		archive, closeArchive, err := openTar(archivePath, gzipped)
+		if err != nil {
+			return nil, err
+		}
+		defer closeArchive()
+
+		for n := 0; n <= i; n++ {
+			if _, err := archive.Next(); err != nil {
+				return nil, fmt.Errorf("%s: entry %d: %v", archivePath, i, err)
+			}
+		}
+
+		return ioutil.ReadAll(archive)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// tileVariant is an extra tile candidate derived from a tile photo
+type tileVariant struct {
+	name      string
+	transform func(image.Image) image.Image
+}
+
+// tileVariants turns the -augment list (rotate, flip, hue, grey)
+// into the variants created for every tile. The first variant is
+// always the untouched tile.
+func tileVariants(augment string) ([]tileVariant, error) {
+
+	variants := []tileVariant{{name: "", transform: nil}}
+
+	for _, kind := range strings.Split(augment, ",") {
+		switch strings.TrimSpace(kind) {
+		case "":
+		case "rotate":
+			variants = append(variants,
+				tileVariant{"rot90", rotate90},
+				tileVariant{"rot180", rotate180},
+				tileVariant{"rot270", rotate270})
+		case "flip":
+			variants = append(variants,
+				tileVariant{"flipH", flipHorizontal},
+				tileVariant{"flipV", flipVertical})
+		case "hue":
+			variants = append(variants,
+				tileVariant{"hue120", func(img image.Image) image.Image { return hueShift(img, 120) }},
+				tileVariant{"hue240", func(img image.Image) image.Image { return hueShift(img, 240) }})
+		case "grey", "gray":
+			variants = append(variants, tileVariant{"grey", greyscale})
+		default:
+			return nil, fmt.Errorf("unknown augmentation %q (use rotate, flip, hue or grey)", kind)
+		}
+	}
+
+	return variants, nil
+}
+
+// tileID is the key of a tile (variant) in the tiles map
+func tileID(filename, variant string) string {
+	if variant == "" {
+		return filename
+	}
+	return filename + "#" + variant
+}
+
+// remap copies src into a new w x h image, pixel (x, y) of the new image
+// being taken from the source pixel returned by from
+func remap(src image.Image, w, h int, from func(x, y int) (int, int)) image.Image {
+
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := from(x, y)
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return dst
+}
+
+// clockwise rotation by 90 degrees
+func rotate90(src image.Image) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	return remap(src, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+}
+
+func rotate180(src image.Image) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	return remap(src, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+}
+
+func rotate270(src image.Image) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	return remap(src, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+}
+
+// mirror image along the vertical axis
+func flipHorizontal(src image.Image) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	return remap(src, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+}
+
+// mirror image along the horizontal axis
+func flipVertical(src image.Image) image.Image {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	return remap(src, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+}
+
+// recolour applies a colour transformation to every pixel of src
+func recolour(src image.Image, convert func(color.Color) color.Color) image.Image {
+
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Set(x-b.Min.X, y-b.Min.Y, convert(src.At(x, y)))
+		}
+	}
+
+	return dst
+}
+
+func greyscale(src image.Image) image.Image {
+	return recolour(src, color.GrayModel.Convert)
+}
+
+// hueShift rotates the hue of every pixel by the given number of degrees,
+// keeping the luminance (the usual hue-rotate colour matrix)
+func hueShift(src image.Image, degrees float64) image.Image {
+
+	cos := math.Cos(degrees * math.Pi / 180)
+	sin := math.Sin(degrees * math.Pi / 180)
+
+	m := [3][3]float64{
+		{0.213 + cos*0.787 - sin*0.213, 0.715 - cos*0.715 - sin*0.715, 0.072 - cos*0.072 + sin*0.928},
+		{0.213 - cos*0.213 + sin*0.143, 0.715 + cos*0.285 + sin*0.140, 0.072 - cos*0.072 - sin*0.283},
+		{0.213 - cos*0.213 - sin*0.787, 0.715 - cos*0.715 + sin*0.715, 0.072 + cos*0.928 + sin*0.072},
+	}
+
+	clamp := func(v float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, v)))
+	}
+
+	return recolour(src, func(c color.Color) color.Color {
+		r, g, b, a := c.RGBA()
+		rf, gf, bf := float64(r>>8), float64(g>>8), float64(b>>8)
+
+		return color.RGBA{
+			clamp(m[0][0]*rf + m[0][1]*gf + m[0][2]*bf),
+			clamp(m[1][0]*rf + m[1][1]*gf + m[1][2]*bf),
+			clamp(m[2][0]*rf + m[2][1]*gf + m[2][2]*bf),
+			uint8(a >> 8),
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drawCells fills dst with the grout or background colour and draws the
+// matched tiles of the cells overlapping it, masked to the cell and tile
+// shape. The scaled tiles are taken from tiles, loading them is part of
+// the draw time.
+func drawCells(ctx context.Context, dst *image.RGBA, cells []cell, matches []*TileImage, tiles *scaledTiles,
+	style *cellStyle, workers int, times *stageTimes) error {
+
+	start := time.Now()
+
+	if style.gap > 0 {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(style.gapColour), image.Point{}, draw.Src)
+	} else {
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(style.background), image.Point{}, draw.Src)
+	}
+
+	times.since("draw", start)
+
+	// dst is split into one row band per worker, each worker draws the
+	// cells overlapping its band, clipped to it. The bands are disjoint,
+	// so the workers never write the same pixels and need no lock, even
+	// where cells (hexagons, shadows) overlap.
+	var wg sync.WaitGroup
+
+	bands := rowBands(dst.Bounds(), workers)
+	loadErrors := make(chan error, len(bands))
+
+	for _, band := range bands {
+		wg.Add(1)
+		go func(band *image.RGBA) {
+			defer wg.Done()
+
+			start := time.Now()
+			defer times.since("draw", start)
+
+			for i, c := range cells {
+				if ctx.Err() != nil {
+					return
+				}
+
+				if !c.bounds.Overlaps(band.Rect) {
+					continue
+				}
+
+				scaled, err := tiles.get(matches[i])
+				if err != nil {
+					loadErrors <- decodeError(matches[i].filename, err)
+					return
+				}
+
+				drawCell(band, c, scaled, style)
+			}
+		}(dst.SubImage(band).(*image.RGBA))
+	}
+
+	wg.Wait()
+
+	select {
+	case err := <-loadErrors:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// renderBands draws the mosaic of bounds band after band into one
+// reused buffer of bandHeight rows and streams the bands out as png,
+// only a band of the mosaic is in memory at a time
+func renderBands(ctx context.Context, w io.Writer, bounds image.Rectangle, bandHeight int,
+	cells []cell, matches []*TileImage, tiles *scaledTiles, style *cellStyle, workers int, times *stageTimes) error {
+
+	start := time.Now()
+	stream, err := newPNGStream(w, bounds.Dx(), bounds.Dy())
+	if err != nil {
+		return err
+	}
+	times.since("encode", start)
+
+	pix := make([]byte, 4*bounds.Dx()*minInt(bandHeight, bounds.Dy()))
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += bandHeight {
+		r := image.Rect(bounds.Min.X, y, bounds.Max.X, minInt(y+bandHeight, bounds.Max.Y))
+		band := &image.RGBA{Pix: pix[:4*r.Dx()*r.Dy()], Stride: 4 * r.Dx(), Rect: r}
+
+		if err := drawCells(ctx, band, cells, matches, tiles, style, workers, times); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		err := stream.writeRows(band)
+		times.since("encode", start)
+		if err != nil {
+			return err
+		}
+	}
+
+	start = time.Now()
+	defer times.since("encode", start)
+
+	return stream.close()
+}
+
+// bandRows is the height of the bands of a width pixels wide mosaic
+// whose buffer takes at most a quarter of the memory budget, the rest
+// is left to the decoded target and the tiles
+func bandRows(maxMemory int64, width int) (int, error) {
+
+	rows := maxMemory / 4 / int64(4*width)
+	if rows < 1 {
+		return 0, fmt.Errorf("-max-memory %d bytes is too small for a %d pixels wide mosaic", maxMemory, width)
+	}
+	if rows > 1<<30 {
+		rows = 1 << 30
+	}
+
+	return int(rows), nil
+}
+
+// parseBytes parses a memory size like 512MB, 2G or 1048576 (bytes)
+func parseBytes(size string) (int64, error) {
+
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "B")
+
+	unit := int64(1)
+	for _, suffix := range []struct {
+		suffix string
+		unit   int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}} {
+		if strings.HasSuffix(s, suffix.suffix) {
+			s, unit = strings.TrimSuffix(s, suffix.suffix), suffix.unit
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q, expected e.g. 512MB or 2GB", size)
+	}
+
+	return n * unit, nil
+}
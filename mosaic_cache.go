@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// mipSizes are the sizes of the pre-scaled copies of every tile, each
+// scaled (keeping the aspect ratio) to cover a size x size square
+var mipSizes = []int{16, 32, 64, 128}
+
+// tileMips is a tile pre-scaled to all mipSizes, smallest first
+type tileMips struct {
+	levels []image.Image
+}
+
+// mipFilter scales the mips. The cache is shared by runs with any
+// -filter, so the mips do not depend on it, -filter only scales them
+// down to the tile size.
+var mipFilter = scaleFilter{name: "auto"}
+
+// newTileMips scales the tile down to the largest size and every
+// smaller size from the one above it
+func newTileMips(tileImage image.Image) *tileMips {
+
+	levels := make([]image.Image, len(mipSizes))
+
+	for i := len(mipSizes) - 1; i >= 0; i-- {
+		levels[i] = scaleToCover(tileImage, mipSizes[i], mipSizes[i], mipFilter)
+		tileImage = levels[i]
+	}
+
+	return &tileMips{levels: levels}
+}
+
+// colour is the average colour of the largest mip, the tile's signature
+func (mips *tileMips) colour() []float64 {
+
+	level := mips.levels[len(mips.levels)-1]
+	bounds := level.Bounds()
+
+	return getImageColour(level, bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y)
+}
+
+// mipsCover tells if the mips are large enough for width x height tiles
+func mipsCover(width, height int) bool {
+	return maxInt(width, height) <= mipSizes[len(mipSizes)-1]
+}
+
+// scale picks the smallest level covering width x height, the nearest
+// larger size, and scales it down cheaply to cover width x height
+func (mips *tileMips) scale(width, height int, filter scaleFilter) image.Image {
+
+	return scaleDown(mips.levels[mipLevel(width, height)], width, height, filter)
+}
+
+// mipLevel is the smallest mip covering width x height, as the shorter
+// side of a mip is its size, the first one at least as large as both
+func mipLevel(width, height int) int {
+
+	for i, size := range mipSizes {
+		if size >= maxInt(width, height) {
+			return i
+		}
+	}
+
+	return len(mipSizes) - 1
+}
+
+// scaleDown scales a mip to cover width x height, cheaply with bilinear
+// unless another filter was chosen
+func scaleDown(level image.Image, width, height int, filter scaleFilter) image.Image {
+	return scaleToCover(level, width, height, filter.or("bilinear"))
+}
+
+// tileCache keeps the mips and the colour of the tiles in a directory,
+// as png files listed in index.json. Tiles are identified by a hash of
+// their file content and their variant, so renamed or moved tiles are
+// still found and changed ones are not.
+type tileCache struct {
+	dir     string
+	mutex   sync.Mutex
+	index   map[string]*cacheEntry
+	changed bool
+}
+
+type cacheEntry struct {
+	Name       string    `json:"name"`
+	Variant    string    `json:"variant,omitempty"`
+	AverageRGB []float64 `json:"averageRGB"`
+	// mip files, one per mipSizes entry
+	Mips []string `json:"mips"`
+}
+
+const cacheIndex = "index.json"
+
+func openTileCache(dir string) (*tileCache, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	cache := &tileCache{dir: dir, index: make(map[string]*cacheEntry)}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, cacheIndex))
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &cache.index); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, cacheIndex), err)
+	}
+
+	return cache, nil
+}
+
+// cacheKey identifies a tile variant by the content of the tile file
+func cacheKey(data []byte, variant string) string {
+
+	sum := sha1.Sum(data)
+	key := hex.EncodeToString(sum[:])
+
+	if variant != "" {
+		key += "-" + variant
+	}
+
+	return key
+}
+
+func (cache *tileCache) entry(key string) *cacheEntry {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry := cache.index[key]
+	if entry == nil || len(entry.Mips) != len(mipSizes) || len(entry.AverageRGB) != 3 {
+		return nil
+	}
+
+	return entry
+}
+
+// mips reads the mips of a cached tile
+func (cache *tileCache) mips(entry *cacheEntry) (*tileMips, error) {
+
+	levels := make([]image.Image, len(entry.Mips))
+
+	for i, mip := range entry.Mips {
+		img, err := decodeImage(filepath.Join(cache.dir, mip))
+		if err != nil {
+			return nil, err
+		}
+		levels[i] = img
+	}
+
+	return &tileMips{levels: levels}, nil
+}
+
+// reload reads only the mip nearest larger than width x height of a
+// cached tile, for lazily loaded tiles
+func (cache *tileCache) reload(entry *cacheEntry, filter scaleFilter) func(width, height int) (image.Image, error) {
+	return func(width, height int) (image.Image, error) {
+
+		level, err := decodeImage(filepath.Join(cache.dir, entry.Mips[mipLevel(width, height)]))
+		if err != nil {
+			return nil, err
+		}
+
+		return scaleDown(level, width, height, filter), nil
+	}
+}
+
+// put stores the mips and the colour of a tile
+func (cache *tileCache) put(ctx context.Context, key, name, variant string, mips *tileMips, averageRGB []float64) error {
+
+	entry := &cacheEntry{Name: name, Variant: variant, AverageRGB: averageRGB}
+
+	for i, level := range mips.levels {
+		mip := fmt.Sprintf("%s-%d.png", key, mipSizes[i])
+
+		err := writeOutput(ctx, filepath.Join(cache.dir, mip), func(w io.Writer) error {
+			return png.Encode(w, level)
+		})
+		if err != nil {
+			return err
+		}
+
+		entry.Mips = append(entry.Mips, mip)
+	}
+
+	cache.mutex.Lock()
+	cache.index[key] = entry
+	cache.changed = true
+	cache.mutex.Unlock()
+
+	return nil
+}
+
+// save writes the index, if tiles were added
+func (cache *tileCache) save(ctx context.Context) error {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if !cache.changed {
+		return nil
+	}
+
+	return writeOutput(ctx, filepath.Join(cache.dir, cacheIndex), func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(cache.index)
+	})
+}
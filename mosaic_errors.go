@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// kinds of errors of the images read, test with errors.Is
+var (
+	ErrRead              = errors.New("cannot read file")
+	ErrDecode            = errors.New("cannot decode image")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrEmptyLibrary      = errors.New("tile library has no tiles")
+)
+
+// imageError is the error of the image (a tile, the target ...) name,
+// its kind is one of the Err values above
+type imageError struct {
+	name string
+	kind error
+	err  error
+}
+
+func (e *imageError) Error() string {
+
+	if e.err == nil {
+		return fmt.Sprintf("%s: %v", e.name, e.kind)
+	}
+
+	return fmt.Sprintf("%s: %v: %v", e.name, e.kind, e.err)
+}
+
+func (e *imageError) Unwrap() error {
+	return e.kind
+}
+
+// decodeError tells apart images in formats without a registered
+// decoder from broken ones
+func decodeError(name string, err error) error {
+
+	// already told apart, e.g. by decodeImage
+	var typed *imageError
+	if errors.As(err, &typed) {
+		return err
+	}
+
+	if errors.Is(err, image.ErrFormat) {
+		return &imageError{name: name, kind: ErrUnsupportedFormat}
+	}
+
+	return &imageError{name: name, kind: ErrDecode, err: err}
+}
+
+// readError is the error of a file a tile source failed to read
+func readError(name string, err error) error {
+	return &imageError{name: name, kind: ErrRead, err: err}
+}
+
+// errorList collects the errors of the concurrently processed tiles
+type errorList struct {
+	mutex sync.Mutex
+	errs  []error
+}
+
+func (list *errorList) add(err error) {
+
+	list.mutex.Lock()
+	list.errs = append(list.errs, err)
+	list.mutex.Unlock()
+}
+
+func (list *errorList) len() int {
+
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	return len(list.errs)
+}
+
+// summary lists the errors sorted by name, at most limit of them,
+// preceded by the number of errors of each kind
+func (list *errorList) summary(limit int) string {
+
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+
+	messages := make([]string, len(list.errs))
+	for i, err := range list.errs {
+		messages[i] = err.Error()
+	}
+	sort.Strings(messages)
+
+	var counts []string
+	for _, kind := range []error{ErrRead, ErrDecode, ErrUnsupportedFormat, ErrEmptyLibrary} {
+		count := 0
+		for _, err := range list.errs {
+			if errors.Is(err, kind) {
+				count++
+			}
+		}
+		if count > 0 {
+			counts = append(counts, fmt.Sprintf("%d %v", count, kind))
+		}
+	}
+
+	var summary strings.Builder
+	fmt.Fprintf(&summary, "%d skipped (%s)\n", len(list.errs), strings.Join(counts, ", "))
+
+	for i, message := range messages {
+		if i == limit {
+			fmt.Fprintf(&summary, "\t... %d more\n", len(messages)-limit)
+			break
+		}
+		fmt.Fprintf(&summary, "\t%s\n", message)
+	}
+
+	return summary.String()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/nfnt/resize"
+)
+
+// scaleFilter is the resampling filter images are scaled with:
+// area, auto or one of the interpolations
+type scaleFilter struct {
+	name string
+}
+
+var interpolations = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// parseFilter reads the -filter name, "" or auto picks area averaging
+// for heavy downscaling and lanczos3 otherwise
+func parseFilter(name string) (scaleFilter, error) {
+
+	if name == "" || name == "auto" {
+		return scaleFilter{name: "auto"}, nil
+	}
+
+	if _, ok := interpolations[name]; !ok && name != "area" {
+		return scaleFilter{}, fmt.Errorf("unknown filter %q (use nearest, bilinear, bicubic, lanczos2, lanczos3, area or auto)", name)
+	}
+
+	return scaleFilter{name: name}, nil
+}
+
+// or is the filter, or the given one when the filter is auto
+func (filter scaleFilter) or(name string) scaleFilter {
+
+	if filter.name != "auto" {
+		return filter
+	}
+
+	return scaleFilter{name: name}
+}
+
+// resize scales img to width x height, a 0 width or height keeps the
+// aspect ratio, like resize.Resize
+func (filter scaleFilter) resize(img image.Image, width, height int) image.Image {
+
+	bounds := img.Bounds()
+
+	targetWidth, targetHeight := width, height
+	if width == 0 {
+		targetWidth = maxInt(int(math.Round(float64(height)*float64(bounds.Dx())/float64(bounds.Dy()))), 1)
+	}
+	if height == 0 {
+		targetHeight = maxInt(int(math.Round(float64(width)*float64(bounds.Dy())/float64(bounds.Dx()))), 1)
+	}
+
+	name := filter.name
+	if name == "auto" {
+		// shrinking to less than half the size, the interpolating
+		// filters are slow and skip pixels, averaging is neither
+		name = "lanczos3"
+		if 2*targetWidth < bounds.Dx() && 2*targetHeight < bounds.Dy() {
+			name = "area"
+		}
+	}
+
+	if name == "area" {
+		return areaResize(img, targetWidth, targetHeight)
+	}
+
+	return resize.Resize(uint(width), uint(height), img, interpolations[name])
+}
+
+// areaResize scales img down by averaging the source pixels covered by
+// every target pixel, weighted by how much of each pixel is covered.
+// Colours are averaged premultiplied, so transparent pixels don't
+// darken the edges.
+func areaResize(img image.Image, width, height int) image.Image {
+
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	columns := areaWeights(bounds.Dx(), width)
+	rows := areaWeights(bounds.Dy(), height)
+
+	// one source row at a time, converted to RGBA
+	row := image.NewRGBA(image.Rect(bounds.Min.X, 0, bounds.Max.X, 1))
+	reduced := make([]float64, 4*width)
+	sums := make([]float64, 4*width)
+
+	for y, sources := range rows {
+		for i := range sums {
+			sums[i] = 0
+		}
+
+		for _, source := range sources {
+			sy := bounds.Min.Y + source.index
+
+			row.Rect = image.Rect(bounds.Min.X, sy, bounds.Max.X, sy+1)
+			draw.Draw(row, row.Rect, img, row.Rect.Min, draw.Src)
+
+			for i := range reduced {
+				reduced[i] = 0
+			}
+
+			for x, columnSources := range columns {
+				for _, column := range columnSources {
+					pix := row.Pix[4*column.index:]
+					for c := 0; c < 4; c++ {
+						reduced[4*x+c] += column.weight * float64(pix[c])
+					}
+				}
+			}
+
+			for i, v := range reduced {
+				sums[i] += source.weight * v
+			}
+		}
+
+		for i, v := range sums {
+			dst.Pix[y*dst.Stride+i] = uint8(math.Min(math.Round(v), 255))
+		}
+	}
+
+	return dst
+}
+
+type areaWeight struct {
+	index  int
+	weight float64
+}
+
+// areaWeights lists, for every one of the size target pixels, the source
+// pixels it covers and the covered part of each, the parts adding up to 1
+func areaWeights(sourceSize, size int) [][]areaWeight {
+
+	weights := make([][]areaWeight, size)
+	scale := float64(sourceSize) / float64(size)
+
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+
+		for s := int(start); s < sourceSize && float64(s) < end; s++ {
+			covered := math.Min(end, float64(s+1)) - math.Max(start, float64(s))
+			if covered > 0 {
+				weights[i] = append(weights[i], areaWeight{index: s, weight: covered / scale})
+			}
+		}
+	}
+
+	return weights
+}
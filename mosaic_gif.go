@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"os"
+)
+
+// gifTiles expands every frame of an animated gif into a tile named
+// file.gif#frameN. Frames are composited onto the logical screen the
+// way a viewer shows them, honouring the frame disposal methods.
+func gifTiles(gifPath string) tileSource {
+	return func(emit emitTile) error {
+
+		file, err := os.Open(gifPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		animation, err := gif.DecodeAll(bufio.NewReader(file))
+		if err != nil {
+			return fmt.Errorf("%s: %v", gifPath, err)
+		}
+
+		screen := image.Rect(0, 0, animation.Config.Width, animation.Config.Height)
+		if screen.Empty() && len(animation.Image) > 0 {
+			screen = animation.Image[0].Bounds()
+		}
+
+		canvas := image.NewRGBA(screen)
+
+		for i, frame := range animation.Image {
+
+			disposal := byte(0)
+			if i < len(animation.Disposal) {
+				disposal = animation.Disposal[i]
+			}
+
+			var previous *image.RGBA
+			if disposal == gif.DisposalPrevious {
+				previous = copyRGBA(canvas)
+			}
+
+			draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+			if err := emit(fmt.Sprintf("%s#frame%d", gifPath, i), loaded(copyRGBA(canvas))); err != nil {
+				return err
+			}
+
+			switch disposal {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+
+		return nil
+	}
+}
+
+func copyRGBA(img *image.RGBA) *image.RGBA {
+
+	dst := image.NewRGBA(img.Bounds())
+	copy(dst.Pix, img.Pix)
+
+	return dst
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// cell is a place of the mosaic that gets one tile
+type cell struct {
+	bounds image.Rectangle
+	// mask selects the pixels of bounds belonging to the cell,
+	// nil for rectangular cells
+	mask image.Image
+}
+
+// gridOptions are the cli settings of the grid layouts
+type gridOptions struct {
+	grid     string
+	hex      string
+	variance float64
+	minTile  int
+	seeds    string
+	cells    int
+}
+
+// gridCells lays out the cells of the requested grid over the image.
+// The layouts going over every pixel of the image (quadtree, voronoi)
+// stop when the context is cancelled.
+func gridCells(ctx context.Context, img image.Image, sampler colourSampler, xDelta, yDelta int, options gridOptions) ([]cell, error) {
+
+	bounds := img.Bounds()
+	hex := options.hex
+
+	switch options.grid {
+	case "rect":
+		return rectGrid(bounds, xDelta, yDelta), nil
+	case "hex":
+		if hex != "pointy" && hex != "flat" {
+			return nil, fmt.Errorf("unknown hexagon orientation %q (use pointy or flat)", hex)
+		}
+		return hexGrid(bounds, xDelta, hex == "pointy"), nil
+	case "brick":
+		return brickGrid(bounds, xDelta, yDelta), nil
+	case "herringbone":
+		return herringboneGrid(bounds, xDelta), nil
+	case "quadtree":
+		if options.minTile <= 0 {
+			return nil, fmt.Errorf("minimum tile size must be > 0, got %d", options.minTile)
+		}
+		return quadtreeGrid(ctx, sampler, bounds, xDelta, yDelta, options.variance, options.minTile)
+	case "voronoi":
+		return voronoiGrid(ctx, img, options.cells, options.seeds)
+	}
+
+	return nil, fmt.Errorf("unknown grid %q (use rect, hex, brick, herringbone, quadtree or voronoi)", options.grid)
+}
+
+// cellsSize is the size of the largest cell, the size tiles are scaled to
+func cellsSize(cells []cell) (int, int) {
+
+	width, height := 0, 0
+
+	for _, c := range cells {
+		if c.bounds.Dx() > width {
+			width = c.bounds.Dx()
+		}
+		if c.bounds.Dy() > height {
+			height = c.bounds.Dy()
+		}
+	}
+
+	return width, height
+}
+
+// rowBands splits bounds into (at most) count disjoint horizontal bands
+// of about the same height
+func rowBands(bounds image.Rectangle, count int) []image.Rectangle {
+
+	count = maxInt(minInt(count, bounds.Dy()), 1)
+
+	bands := make([]image.Rectangle, 0, count)
+
+	for i := 0; i < count; i++ {
+		y0 := bounds.Min.Y + i*bounds.Dy()/count
+		y1 := bounds.Min.Y + (i+1)*bounds.Dy()/count
+		bands = append(bands, image.Rect(bounds.Min.X, y0, bounds.Max.X, y1))
+	}
+
+	return bands
+}
+
+// tileOrigin is the point of the scaled tile drawn at the cell's top left
+// corner, so that the middle of the tile is shown in smaller cells
+func tileOrigin(scaledTile image.Image, bounds image.Rectangle) image.Point {
+
+	tileBounds := scaledTile.Bounds()
+
+	return tileBounds.Min.Add(image.Pt((tileBounds.Dx()-bounds.Dx())/2, (tileBounds.Dy()-bounds.Dy())/2))
+}
+
+// rectGrid steps along the x and y axes by xDelta and yDelta
+func rectGrid(bounds image.Rectangle, xDelta, yDelta int) []cell {
+
+	var cells []cell
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += yDelta {
+		for x := bounds.Min.X; x < bounds.Max.X; x += xDelta {
+			cells = append(cells, cell{bounds: image.Rect(x, y, x+xDelta, y+yDelta)})
+		}
+	}
+
+	return cells
+}
+
+// brickGrid is the running bond pattern, every other row of the rect
+// grid shifted by half a tile. The cells sticking out of the image are
+// kept, only their inside part gets sampled and drawn.
+func brickGrid(bounds image.Rectangle, xDelta, yDelta int) []cell {
+
+	var cells []cell
+
+	for row, y := 0, bounds.Min.Y; y < bounds.Max.Y; row, y = row+1, y+yDelta {
+
+		xStart := bounds.Min.X
+		if row%2 == 1 {
+			xStart -= xDelta / 2
+		}
+
+		for x := xStart; x < bounds.Max.X; x += xDelta {
+			cells = append(cells, cell{bounds: image.Rect(x, y, x+xDelta, y+yDelta)})
+		}
+	}
+
+	return cells
+}
+
+// herringboneGrid lays out 2:1 bricks, xDelta long, alternately
+// horizontal and vertical, in diagonal zigzag rows. With the brick width
+// as the unit, a horizontal brick sits at (s, d) and a vertical one
+// right below it for every s, d with s - d divisible by 4.
+func herringboneGrid(bounds image.Rectangle, xDelta int) []cell {
+
+	var cells []cell
+
+	unit := xDelta / 2
+	if unit <= 0 {
+		unit = 1
+	}
+
+	columns := bounds.Dx()/unit + 1
+	rows := bounds.Dy()/unit + 1
+
+	for d := -3; d <= rows; d++ {
+		for s := -3; s <= columns; s++ {
+			if (s-d)%4 != 0 {
+				continue
+			}
+
+			x := bounds.Min.X + s*unit
+			y := bounds.Min.Y + d*unit
+
+			horizontal := image.Rect(x, y, x+2*unit, y+unit)
+			vertical := image.Rect(x, y+unit, x+unit, y+3*unit)
+
+			for _, r := range []image.Rectangle{horizontal, vertical} {
+				if r.Overlaps(bounds) {
+					cells = append(cells, cell{bounds: r})
+				}
+			}
+		}
+	}
+
+	return cells
+}
+
+// quadtreeGrid starts with the rect grid and splits every cell whose
+// colour variance exceeds the threshold into four, recursively, as long
+// as the new cells are at least minTile pixels large
+func quadtreeGrid(ctx context.Context, sampler colourSampler, bounds image.Rectangle, xDelta, yDelta int,
+	threshold float64, minTile int) ([]cell, error) {
+
+	var cells []cell
+	var split func(r image.Rectangle)
+
+	split = func(r image.Rectangle) {
+
+		_, variance := sampler.variance(r)
+
+		if variance <= threshold || r.Dx()/2 < minTile || r.Dy()/2 < minTile {
+			cells = append(cells, cell{bounds: r})
+			return
+		}
+
+		xMid := r.Min.X + r.Dx()/2
+		yMid := r.Min.Y + r.Dy()/2
+
+		for _, child := range []image.Rectangle{
+			image.Rect(r.Min.X, r.Min.Y, xMid, yMid),
+			image.Rect(xMid, r.Min.Y, r.Max.X, yMid),
+			image.Rect(r.Min.X, yMid, xMid, r.Max.Y),
+			image.Rect(xMid, yMid, r.Max.X, r.Max.Y),
+		} {
+			if child.Overlaps(bounds) {
+				split(child)
+			}
+		}
+	}
+
+	for _, root := range rectGrid(bounds, xDelta, yDelta) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		split(root.bounds)
+	}
+
+	return cells, nil
+}
+
+// hexGrid lays out a honeycomb of hexagons, xDelta apart horizontally.
+// Pointy-top hexagons sit in rows, every other row shifted by half
+// a hexagon; flat-top hexagons sit in columns, every other column
+// shifted by half a hexagon.
+func hexGrid(bounds image.Rectangle, xDelta int, pointy bool) []cell {
+
+	var cells []cell
+
+	width := float64(xDelta)
+
+	if pointy {
+		size := width / math.Sqrt(3)
+
+		for row := 0; ; row++ {
+			cy := float64(bounds.Min.Y) + float64(row)*1.5*size
+			if cy-size >= float64(bounds.Max.Y) {
+				break
+			}
+
+			shift := 0.0
+			if row%2 == 1 {
+				shift = width / 2
+			}
+
+			for col := 0; ; col++ {
+				cx := float64(bounds.Min.X) + float64(col)*width + shift
+				if cx-width/2 >= float64(bounds.Max.X) {
+					break
+				}
+				cells = append(cells, hexCell(cx, cy, size, true))
+			}
+		}
+
+		return cells
+	}
+
+	size := width / 1.5
+	height := size * math.Sqrt(3)
+
+	for col := 0; ; col++ {
+		cx := float64(bounds.Min.X) + float64(col)*width
+		if cx-size >= float64(bounds.Max.X) {
+			break
+		}
+
+		shift := 0.0
+		if col%2 == 1 {
+			shift = height / 2
+		}
+
+		for row := 0; ; row++ {
+			cy := float64(bounds.Min.Y) + float64(row)*height + shift
+			if cy-height/2 >= float64(bounds.Max.Y) {
+				break
+			}
+			cells = append(cells, hexCell(cx, cy, size, false))
+		}
+	}
+
+	return cells
+}
+
+func hexCell(cx, cy, size float64, pointy bool) cell {
+
+	mask := &hexMask{cx: cx, cy: cy, size: size, pointy: pointy}
+
+	halfWidth, halfHeight := size*math.Sqrt(3)/2, size
+	if !pointy {
+		halfWidth, halfHeight = halfHeight, halfWidth
+	}
+
+	mask.bounds = image.Rect(
+		int(math.Floor(cx-halfWidth)), int(math.Floor(cy-halfHeight)),
+		int(math.Ceil(cx+halfWidth)), int(math.Ceil(cy+halfHeight)))
+
+	return cell{bounds: mask.bounds, mask: mask}
+}
+
+// hexMask is opaque inside a hexagon with centre cx, cy and size
+// (centre to corner distance) and transparent outside of it
+type hexMask struct {
+	cx, cy float64
+	size   float64
+	pointy bool
+	bounds image.Rectangle
+}
+
+func (m *hexMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m *hexMask) Bounds() image.Rectangle {
+	return m.bounds
+}
+
+func (m *hexMask) At(x, y int) color.Color {
+
+	// distances of the pixel centre from the hexagon centre
+	dx := math.Abs(float64(x) + 0.5 - m.cx)
+	dy := math.Abs(float64(y) + 0.5 - m.cy)
+
+	if !m.pointy {
+		dx, dy = dy, dx
+	}
+
+	if dx <= m.size*math.Sqrt(3)/2 && dy <= m.size-dx/math.Sqrt(3) {
+		return color.Opaque
+	}
+
+	return color.Transparent
+}
+
+// getMaskedColour averages the pixels of the image inside the mask,
+// weighted by the mask alpha
+func getMaskedColour(img image.Image, bounds image.Rectangle, mask image.Image) []float64 {
+
+	var rSum, gSum, bSum, weight float64 = 0.0, 0.0, 0.0, 0.0
+
+	bounds = bounds.Intersect(img.Bounds())
+	row := make([]uint32, 3*bounds.Dx())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+
+		readRow(img, y, bounds.Min.X, bounds.Max.X, row)
+
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			_, _, _, a := mask.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+
+			w := float64(a) / 0xffff
+			i := 3 * (x - bounds.Min.X)
+			rSum += w * float64(row[i])
+			gSum += w * float64(row[i+1])
+			bSum += w * float64(row[i+2])
+			weight += w
+		}
+	}
+
+	if weight == 0 {
+		return []float64{0, 0, 0}
+	}
+
+	return []float64{rSum / weight, gSum / weight, bSum / weight}
+}
+
+// fitTile returns the scaled tile when it already covers the cell
+// snugly, otherwise the tile rescaled to the cell size
+func fitTile(scaledTile image.Image, bounds image.Rectangle, filter scaleFilter) image.Image {
+
+	tileBounds := scaledTile.Bounds()
+
+	if tileBounds.Dx() == bounds.Dx() && tileBounds.Dy() >= bounds.Dy() ||
+		tileBounds.Dy() == bounds.Dy() && tileBounds.Dx() >= bounds.Dx() {
+		return scaledTile
+	}
+
+	return scaleToCover(scaledTile, bounds.Dx(), bounds.Dy(), filter)
+}
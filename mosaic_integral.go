@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"image"
+)
+
+// integralImage is a summed-area table of an image: entry (x, y) holds
+// the sums of the r, g, b values and of their squares over all pixels
+// above and left of x, y. The average and variance of any rectangle
+// then take four lookups, whatever its size.
+type integralImage struct {
+	bounds image.Rectangle
+	stride int
+	// r, g, b, r², g², b² sums, 6 values per entry
+	sums []uint64
+}
+
+// newIntegralImage sums up the image row by row, it stops when the
+// context is cancelled
+func newIntegralImage(ctx context.Context, img image.Image) (*integralImage, error) {
+
+	bounds := img.Bounds()
+	stride := bounds.Dx() + 1
+
+	integral := &integralImage{
+		bounds: bounds,
+		stride: stride,
+		sums:   make([]uint64, 6*stride*(bounds.Dy()+1)),
+	}
+
+	pixels := make([]uint32, 3*bounds.Dx())
+
+	for y := 0; y < bounds.Dy(); y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var row [6]uint64
+
+		above := integral.sums[6*y*stride:]
+		current := integral.sums[6*(y+1)*stride:]
+
+		readRow(img, bounds.Min.Y+y, bounds.Min.X, bounds.Max.X, pixels)
+
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b := pixels[3*x], pixels[3*x+1], pixels[3*x+2]
+
+			row[0] += uint64(r)
+			row[1] += uint64(g)
+			row[2] += uint64(b)
+			row[3] += uint64(r) * uint64(r)
+			row[4] += uint64(g) * uint64(g)
+			row[5] += uint64(b) * uint64(b)
+
+			for i := 0; i < 6; i++ {
+				current[6*(x+1)+i] = above[6*(x+1)+i] + row[i]
+			}
+		}
+	}
+
+	return integral, nil
+}
+
+// sum returns the six sums over r (clipped to the image) and its pixel count
+func (integral *integralImage) sum(r image.Rectangle) ([6]float64, float64) {
+
+	var sums [6]float64
+
+	r = r.Intersect(integral.bounds)
+	if r.Empty() {
+		return sums, 0
+	}
+
+	x0, y0 := r.Min.X-integral.bounds.Min.X, r.Min.Y-integral.bounds.Min.Y
+	x1, y1 := r.Max.X-integral.bounds.Min.X, r.Max.Y-integral.bounds.Min.Y
+
+	for i := 0; i < 6; i++ {
+		sums[i] = float64(integral.sums[6*(y1*integral.stride+x1)+i] -
+			integral.sums[6*(y0*integral.stride+x1)+i] -
+			integral.sums[6*(y1*integral.stride+x0)+i] +
+			integral.sums[6*(y0*integral.stride+x0)+i])
+	}
+
+	return sums, float64(r.Dx() * r.Dy())
+}
+
+// average is the average colour of r, like getImageColour
+func (integral *integralImage) average(r image.Rectangle) []float64 {
+
+	sums, pixelCount := integral.sum(r)
+	if pixelCount == 0 {
+		return []float64{0, 0, 0}
+	}
+
+	return []float64{sums[0] / pixelCount, sums[1] / pixelCount, sums[2] / pixelCount}
+}
+
+// variance returns the average colour of r together with the colour
+// variance, the sum of the variances of the r, g, b channels in 0-255 units
+func (integral *integralImage) variance(r image.Rectangle) ([]float64, float64) {
+
+	sums, pixelCount := integral.sum(r)
+	if pixelCount == 0 {
+		return []float64{0, 0, 0}, 0
+	}
+
+	average := []float64{sums[0] / pixelCount, sums[1] / pixelCount, sums[2] / pixelCount}
+
+	variance := 0.0
+	for i := 0; i < 3; i++ {
+		variance += sums[3+i]/pixelCount - average[i]*average[i]
+	}
+
+	// 16 bit channel values to 8 bit ones
+	return average, variance / (257 * 257)
+}
+
+// colourSampler gives the average colour and the colour variance of
+// rectangles of an image
+type colourSampler interface {
+	average(r image.Rectangle) []float64
+	variance(r image.Rectangle) ([]float64, float64)
+}
+
+// directSampler reads the pixels of every rectangle it is asked for.
+// It is slower than the integral image for overlapping rectangles but
+// needs no memory of its own, 48 bytes per pixel less.
+type directSampler struct {
+	img image.Image
+}
+
+func (sampler directSampler) average(r image.Rectangle) []float64 {
+	return getImageColour(sampler.img, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+func (sampler directSampler) variance(r image.Rectangle) ([]float64, float64) {
+
+	r = r.Intersect(sampler.img.Bounds())
+	if r.Empty() {
+		return []float64{0, 0, 0}, 0
+	}
+
+	var sums [6]float64
+	row := make([]uint32, 3*r.Dx())
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		readRow(sampler.img, y, r.Min.X, r.Max.X, row)
+
+		for i, v := range row {
+			sums[i%3] += float64(v)
+			sums[3+i%3] += float64(v) * float64(v)
+		}
+	}
+
+	pixelCount := float64(r.Dx() * r.Dy())
+	average := []float64{sums[0] / pixelCount, sums[1] / pixelCount, sums[2] / pixelCount}
+
+	variance := 0.0
+	for i := 0; i < 3; i++ {
+		variance += sums[3+i]/pixelCount - average[i]*average[i]
+	}
+
+	// 16 bit channel values to 8 bit ones
+	return average, variance / (257 * 257)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// scaledTiles hands out the scaled tiles to draw. Lazily loaded tiles
+// are loaded when they are first drawn and kept in a least recently
+// used cache of capacity tiles, so only the tiles placed in the mosaic
+// are ever loaded and only a few of them are in memory at once.
+type scaledTiles struct {
+	capacity int
+	mutex    sync.Mutex
+	entries  map[*TileImage]*list.Element
+	// most recently used first
+	order *list.List
+	loads int
+}
+
+type scaledEntry struct {
+	tile   *TileImage
+	once   sync.Once
+	scaled image.Image
+	err    error
+}
+
+func newScaledTiles(capacity int) *scaledTiles {
+	return &scaledTiles{
+		capacity: maxInt(capacity, 1),
+		entries:  make(map[*TileImage]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the scaled tile, loading it if needed. Workers asking for
+// a tile being loaded wait for it instead of loading it again.
+func (tiles *scaledTiles) get(tile *TileImage) (image.Image, error) {
+
+	if tile.load == nil {
+		return tile.scaled, nil
+	}
+
+	tiles.mutex.Lock()
+
+	element, ok := tiles.entries[tile]
+	if ok {
+		tiles.order.MoveToFront(element)
+	} else {
+		element = tiles.order.PushFront(&scaledEntry{tile: tile})
+		tiles.entries[tile] = element
+		tiles.loads++
+
+		for tiles.order.Len() > tiles.capacity {
+			oldest := tiles.order.Back()
+			tiles.order.Remove(oldest)
+			delete(tiles.entries, oldest.Value.(*scaledEntry).tile)
+		}
+	}
+
+	entry := element.Value.(*scaledEntry)
+
+	tiles.mutex.Unlock()
+
+	entry.once.Do(func() {
+		entry.scaled, entry.err = tile.load()
+	})
+
+	return entry.scaled, entry.err
+}
+
+// loaded is the number of times tiles were loaded
+func (tiles *scaledTiles) loaded() int {
+
+	tiles.mutex.Lock()
+	defer tiles.mutex.Unlock()
+
+	return tiles.loads
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeOutput writes an output file through a temporary file next to it,
+// renamed to path once write succeeded. When write fails or the context
+// is cancelled while writing, the temporary file is removed, so no
+// partially written output is left behind.
+func writeOutput(ctx context.Context, path string, write func(w io.Writer) error) error {
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	// temporary files are private, outputs are readable like os.Create ones
+	err = temp.Chmod(0644)
+	if err == nil {
+		err = write(&contextWriter{ctx, temp})
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+
+	return err
+}
+
+// contextWriter fails the writes once the context is cancelled
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cw.w.Write(p)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+)
+
+// The tiles flow through a pipeline of stages connected by channels:
+//
+//	read ──> decode ──> resize ──> signature ──> index
+//
+// the sources read the files (I/O), the following stages each run their
+// own workers, so reading, decoding and resizing of different tiles
+// overlap. Every channel holds a few tiles only, a slow stage makes the
+// ones before it wait instead of piling up images in memory.
+// Cancelling the context stops all stages, they drop their tiles.
+// Every stage records the time of its work in times.
+
+// decodedTile is a tile variant between the decode and the resize stage
+type decodedTile struct {
+	library  string
+	filename string
+	variant  string
+	// the decoded tile, nil for tiles read from the tile cache
+	image image.Image
+	// with a tile cache, the tile's mips and colour
+	mips       *tileMips
+	averageRGB []float64
+	// for lazily loaded tiles, scales the tile again when it is drawn
+	reload func(width, height int) (image.Image, error)
+}
+
+// startStage runs work on the given number of goroutines and calls
+// done (closing the stage's output channel) after all of them returned
+func startStage(workers int, work func(), done func()) {
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work()
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		done()
+	}()
+}
+
+// readStage runs the tile sources one after the other, sending the
+// read tiles of each library on. Errors end the stage and are reported
+// on the returned channel once all sources ran. The time the sources
+// wait for the decode stage is not part of the load time.
+func readStage(ctx context.Context, sources map[string][]tileSource, libraries []string, capacity int,
+	times *stageTimes) (chan tileJob, chan error) {
+
+	readTiles := make(chan tileJob, capacity)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(readTiles)
+
+		// busy adds up the reading time without the waits in emit, the
+		// current read started at start
+		began := time.Now()
+		start, busy := began, time.Duration(0)
+		defer func() { times.record("load", began, busy+time.Since(start)) }()
+
+		for _, library := range libraries {
+			emit := func(filename string, load loadTile) error {
+				busy += time.Since(start)
+				defer func() { start = time.Now() }()
+
+				select {
+				case readTiles <- tileJob{library: library, filename: filename, load: load}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			for _, source := range sources[library] {
+				if err := source(emit); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}
+
+		readErr <- nil
+	}()
+
+	return readTiles, readErr
+}
+
+// decodeStage decodes the tiles and derives their variants
+// (rotated, flipped, recoloured ...), every variant is a tile of its own.
+// With a tile cache, tiles found in it are not decoded, their mips are
+// read instead, and the mips of new tiles are added to it. Of lazily
+// loaded tiles only the colour is kept, they are loaded again when drawn.
+// Tiles that cannot be read or decoded are skipped, their errors added to errs.
+func decodeStage(ctx context.Context, workers int, readTiles chan tileJob, variants []tileVariant,
+	cache *tileCache, lazy bool, filter scaleFilter, errs *errorList, times *stageTimes) chan decodedTile {
+
+	decodedTiles := make(chan decodedTile, workers)
+
+	startStage(workers, func() {
+		for job := range readTiles {
+			if ctx.Err() != nil {
+				return
+			}
+
+			start := time.Now()
+			tiles, err := decodeTile(ctx, job, variants, cache, lazy, filter)
+			times.since("decode", start)
+			if err != nil {
+				errs.add(decodeError(job.filename, err))
+				continue
+			}
+
+			for _, tile := range tiles {
+				select {
+				case decodedTiles <- tile:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}, func() { close(decodedTiles) })
+
+	return decodedTiles
+}
+
+// decodeTile returns the variants of the tile, from the cache when all
+// of them are cached. Lazily loaded tiles get a reload function
+// scaling them again when they are drawn.
+func decodeTile(ctx context.Context, job tileJob, variants []tileVariant, cache *tileCache, lazy bool,
+	filter scaleFilter) ([]decodedTile, error) {
+
+	tiles := make([]decodedTile, len(variants))
+	for i, variant := range variants {
+		tiles[i] = decodedTile{library: job.library, filename: job.filename, variant: variant.name}
+	}
+
+	if cache != nil && job.load.data != nil && cachedTiles(job, tiles, cache, lazy, filter) {
+		return tiles, nil
+	}
+
+	tileImage, err := job.load.image()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, variant := range variants {
+		tiles[i].image = tileImage
+		if variant.transform != nil {
+			tiles[i].image = variant.transform(tileImage)
+		}
+
+		// the reload function reads the tile again, not holding on to
+		// its data or image
+		if lazy {
+			load, transform := job.load.reloader(), variant.transform
+
+			tiles[i].reload = func(width, height int) (image.Image, error) {
+				tileImage, err := load()
+				if err != nil {
+					return nil, err
+				}
+				if transform != nil {
+					tileImage = transform(tileImage)
+				}
+				return scaleToCover(tileImage, width, height, filter), nil
+			}
+		}
+
+		if cache != nil && job.load.data != nil {
+			key := cacheKey(job.load.data, variant.name)
+
+			tiles[i].mips = newTileMips(tiles[i].image)
+			tiles[i].averageRGB = tiles[i].mips.colour()
+
+			err := cache.put(ctx, key, job.filename, variant.name, tiles[i].mips, tiles[i].averageRGB)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("--> tile cache: %v\n", err)
+			}
+
+			// reloaded from the cache, only the colour is kept
+			if entry := cache.entry(key); lazy && err == nil && entry != nil {
+				tiles[i].image, tiles[i].mips = nil, nil
+				tiles[i].reload = cache.reload(entry, filter)
+			}
+		}
+	}
+
+	return tiles, nil
+}
+
+// cachedTiles fills in the mips and colours of the cached tiles,
+// it fails if any of them is not cached. Lazily loaded tiles read
+// their mip when they are drawn.
+func cachedTiles(job tileJob, tiles []decodedTile, cache *tileCache, lazy bool, filter scaleFilter) bool {
+
+	entries := make([]*cacheEntry, len(tiles))
+
+	for i := range tiles {
+		entries[i] = cache.entry(cacheKey(job.load.data, tiles[i].variant))
+		if entries[i] == nil {
+			return false
+		}
+	}
+
+	for i, entry := range entries {
+		tiles[i].averageRGB = entry.AverageRGB
+
+		if lazy {
+			tiles[i].reload = cache.reload(entry, filter)
+			continue
+		}
+
+		mips, err := cache.mips(entry)
+		if err != nil {
+			return false
+		}
+		tiles[i].mips = mips
+	}
+
+	return true
+}
+
+// resizeStage scales the tiles to cover the tile size. Lazily loaded
+// tiles are scaled here only if their colour is not known yet.
+func resizeStage(ctx context.Context, workers int, decodedTiles chan decodedTile, tileWidth, tileHeight int,
+	filter scaleFilter, times *stageTimes) chan tileMessage {
+
+	resizedTiles := make(chan tileMessage, workers)
+
+	startStage(workers, func() {
+		for decoded := range decodedTiles {
+			if ctx.Err() != nil {
+				return
+			}
+
+			start := time.Now()
+			tile := &TileImage{
+				filename:   decoded.filename,
+				variant:    decoded.variant,
+				averageRGB: decoded.averageRGB,
+			}
+
+			if decoded.reload != nil {
+				reload := decoded.reload
+				tile.load = func() (image.Image, error) {
+					return reload(tileWidth, tileHeight)
+				}
+			}
+
+			switch {
+			case decoded.reload != nil && decoded.averageRGB != nil:
+				// loaded when drawn
+			case decoded.mips != nil:
+				// the nearest larger mip is scaled down cheaply
+				tile.scaled = decoded.mips.scale(tileWidth, tileHeight, filter)
+			default:
+				tile.xMin, tile.yMin = decoded.image.Bounds().Min.X, decoded.image.Bounds().Min.Y
+				tile.scaled = scaleToCover(decoded.image, tileWidth, tileHeight, filter)
+			}
+			times.since("resize", start)
+
+			select {
+			case resizedTiles <- tileMessage{
+				library:  decoded.library,
+				filename: tileID(decoded.filename, decoded.variant),
+				tile:     tile,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}, func() { close(resizedTiles) })
+
+	return resizedTiles
+}
+
+// signatureStage calculates the colour of the resized tiles, cached
+// tiles come with their colour. Only the colour of lazily loaded tiles
+// is kept.
+func signatureStage(ctx context.Context, workers int, resizedTiles chan tileMessage, times *stageTimes) chan tileMessage {
+
+	tileData := make(chan tileMessage, workers)
+
+	startStage(workers, func() {
+		for m := range resizedTiles {
+			if m.tile.averageRGB == nil {
+				start := time.Now()
+				getTileColour(m.tile)
+				times.since("signature", start)
+			}
+
+			// lazily loaded tiles are scaled again when they are drawn
+			if m.tile.load != nil {
+				m.tile.scaled = nil
+			}
+
+			select {
+			case tileData <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}, func() { close(tileData) })
+
+	return tileData
+}
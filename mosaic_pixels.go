@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// readRow stores the r, g, b values (16 bit, as returned by RGBA) of the
+// pixels xMin to xMax-1 of row y into dst, three values per pixel.
+// The image types decoders return are read straight from their pixel
+// slices, avoiding the allocation and dispatch of image.At per pixel.
+func readRow(img image.Image, y, xMin, xMax int, dst []uint32) {
+
+	switch p := img.(type) {
+
+	case *image.YCbCr:
+		for x := xMin; x < xMax; x++ {
+			yi, ci := p.YOffset(x, y), p.COffset(x, y)
+			r, g, b, _ := color.YCbCr{Y: p.Y[yi], Cb: p.Cb[ci], Cr: p.Cr[ci]}.RGBA()
+			dst[0], dst[1], dst[2] = r, g, b
+			dst = dst[3:]
+		}
+
+	case *image.RGBA:
+		pix := p.Pix[p.PixOffset(xMin, y):]
+		for x := xMin; x < xMax; x++ {
+			dst[0], dst[1], dst[2] = uint32(pix[0])*0x101, uint32(pix[1])*0x101, uint32(pix[2])*0x101
+			pix, dst = pix[4:], dst[3:]
+		}
+
+	case *image.NRGBA:
+		pix := p.Pix[p.PixOffset(xMin, y):]
+		for x := xMin; x < xMax; x++ {
+			r, g, b, _ := color.NRGBA{pix[0], pix[1], pix[2], pix[3]}.RGBA()
+			dst[0], dst[1], dst[2] = r, g, b
+			pix, dst = pix[4:], dst[3:]
+		}
+
+	case *image.Gray:
+		pix := p.Pix[p.PixOffset(xMin, y):]
+		for x := xMin; x < xMax; x++ {
+			v := uint32(pix[0]) * 0x101
+			dst[0], dst[1], dst[2] = v, v, v
+			pix, dst = pix[1:], dst[3:]
+		}
+
+	default:
+		for x := xMin; x < xMax; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			dst[0], dst[1], dst[2] = r, g, b
+			dst = dst[3:]
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// placement records which tile was drawn at which position of the mosaic
+type placement struct {
+	x    int
+	y    int
+	tile *TileImage
+}
+
+// writePlacements writes the placements as csv (x, y, tile file, variant)
+func writePlacements(w io.Writer, placements []placement) error {
+
+	sort.Slice(placements, func(i, j int) bool {
+		if placements[i].y != placements[j].y {
+			return placements[i].y < placements[j].y
+		}
+		return placements[i].x < placements[j].x
+	})
+
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write([]string{"x", "y", "tile", "variant"})
+
+	for _, p := range placements {
+		csvWriter.Write([]string{strconv.Itoa(p.x), strconv.Itoa(p.y), p.tile.filename, p.tile.variant})
+	}
+
+	csvWriter.Flush()
+
+	return csvWriter.Error()
+}
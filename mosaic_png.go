@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+)
+
+// pngStream encodes an opaque RGB png a band of rows at a time, so the
+// whole image never has to be in memory. image/png can only encode
+// complete images.
+type pngStream struct {
+	w      *bufio.Writer
+	width  int
+	height int
+	rows   int
+	idat   *idatWriter
+	zlib   *zlib.Writer
+	// the previous row (for the Up filter) and the filtered current row
+	previous []byte
+	current  []byte
+	filtered []byte
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// idatChunkSize is the size of the IDAT chunks the compressed rows are split into
+const idatChunkSize = 1 << 16
+
+func newPNGStream(w io.Writer, width, height int) (*pngStream, error) {
+
+	stream := &pngStream{
+		w:        bufio.NewWriter(w),
+		width:    width,
+		height:   height,
+		previous: make([]byte, 3*width),
+		current:  make([]byte, 3*width),
+		filtered: make([]byte, 1+3*width),
+	}
+
+	stream.idat = &idatWriter{w: stream.w}
+	stream.zlib = zlib.NewWriter(stream.idat)
+
+	// 8 bit RGB, no interlacing
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(width))
+	binary.BigEndian.PutUint32(header[4:], uint32(height))
+	header[8], header[9] = 8, 2
+
+	if _, err := stream.w.Write(pngSignature); err != nil {
+		return nil, err
+	}
+	if err := writeChunk(stream.w, "IHDR", header); err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// writeRows appends the rows of band, which spans the image width
+func (stream *pngStream) writeRows(band *image.RGBA) error {
+
+	bounds := band.Bounds()
+	if bounds.Dx() != stream.width || stream.rows+bounds.Dy() > stream.height {
+		return fmt.Errorf("png band %v does not fit the %dx%d image", bounds, stream.width, stream.height)
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		pix := band.Pix[band.PixOffset(bounds.Min.X, y):]
+
+		for x := 0; x < stream.width; x++ {
+			copy(stream.current[3*x:3*x+3], pix[4*x:4*x+3])
+		}
+
+		// the Up filter, the difference to the row above
+		stream.filtered[0] = 2
+		for i, v := range stream.current {
+			stream.filtered[1+i] = v - stream.previous[i]
+		}
+
+		if _, err := stream.zlib.Write(stream.filtered); err != nil {
+			return err
+		}
+
+		stream.previous, stream.current = stream.current, stream.previous
+		stream.rows++
+	}
+
+	return nil
+}
+
+// close ends the image, all its rows must have been written
+func (stream *pngStream) close() error {
+
+	if stream.rows != stream.height {
+		return fmt.Errorf("png has %d of %d rows", stream.rows, stream.height)
+	}
+
+	if err := stream.zlib.Close(); err != nil {
+		return err
+	}
+	if err := stream.idat.flush(); err != nil {
+		return err
+	}
+	if err := writeChunk(stream.w, "IEND", nil); err != nil {
+		return err
+	}
+
+	return stream.w.Flush()
+}
+
+// idatWriter cuts the compressed image data into IDAT chunks
+type idatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (idat *idatWriter) Write(p []byte) (int, error) {
+
+	idat.buf = append(idat.buf, p...)
+
+	for len(idat.buf) >= idatChunkSize {
+		if err := writeChunk(idat.w, "IDAT", idat.buf[:idatChunkSize]); err != nil {
+			return 0, err
+		}
+		idat.buf = append(idat.buf[:0], idat.buf[idatChunkSize:]...)
+	}
+
+	return len(p), nil
+}
+
+func (idat *idatWriter) flush() error {
+
+	if len(idat.buf) == 0 {
+		return nil
+	}
+
+	err := writeChunk(idat.w, "IDAT", idat.buf)
+	idat.buf = idat.buf[:0]
+
+	return err
+}
+
+// writeChunk writes a png chunk: length, type, data and crc
+func writeChunk(w io.Writer, kind string, data []byte) error {
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	copy(header[4:], kind)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, part := range [][]byte{header, data, footer} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
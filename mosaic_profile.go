@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"time"
+)
+
+// The profiling and the timing report are shared by all engines, this
+// file depends on the standard library only.
+
+// timedStages are the stages of the timing report, in processing order
+var timedStages = []string{"load", "decode", "resize", "signature", "match", "draw", "encode"}
+
+// stageTimes adds up the time spent in every stage. Most stages run on
+// several workers at once and the pipeline stages overlap each other,
+// so every stage has a busy time, summed over its workers, and a wall
+// time, from the start of its first work to the end of its last.
+type stageTimes struct {
+	mutex  sync.Mutex
+	stages map[string]*stageTime
+}
+
+type stageTime struct {
+	first, last time.Time
+	busy        time.Duration
+}
+
+func newStageTimes() *stageTimes {
+	return &stageTimes{stages: make(map[string]*stageTime)}
+}
+
+// record adds busy time to stage, for work that started at start and
+// has just ended
+func (times *stageTimes) record(stage string, start time.Time, busy time.Duration) {
+
+	end := time.Now()
+
+	times.mutex.Lock()
+	defer times.mutex.Unlock()
+
+	st := times.stages[stage]
+	if st == nil {
+		st = &stageTime{first: start, last: end}
+		times.stages[stage] = st
+	}
+
+	if start.Before(st.first) {
+		st.first = start
+	}
+	if end.After(st.last) {
+		st.last = end
+	}
+	st.busy += busy
+}
+
+// since records the work of stage from start until now
+func (times *stageTimes) since(stage string, start time.Time) {
+	times.record(stage, start, time.Since(start))
+}
+
+// timingReport is the -timings report, in json the durations are in
+// milliseconds
+type timingReport struct {
+	Engine  string        `json:"engine"`
+	Workers int           `json:"workers"`
+	Tiles   int           `json:"tiles"`
+	Cells   int           `json:"cells"`
+	TotalMs float64       `json:"totalMs"`
+	Stages  []stageReport `json:"stages"`
+}
+
+type stageReport struct {
+	Name   string  `json:"name"`
+	WallMs float64 `json:"wallMs"`
+	BusyMs float64 `json:"busyMs"`
+}
+
+// report lists the stages in processing order, stages without any work
+// (e.g. resize of cached, lazily loaded tiles) are 0
+func (times *stageTimes) report(engine string, workers, tiles, cells int, total time.Duration) *timingReport {
+
+	times.mutex.Lock()
+	defer times.mutex.Unlock()
+
+	report := &timingReport{Engine: engine, Workers: workers, Tiles: tiles, Cells: cells, TotalMs: milliseconds(total)}
+
+	for _, stage := range timedStages {
+		sr := stageReport{Name: stage}
+		if st := times.stages[stage]; st != nil {
+			sr.WallMs, sr.BusyMs = milliseconds(st.last.Sub(st.first)), milliseconds(st.busy)
+		}
+		report.Stages = append(report.Stages, sr)
+	}
+
+	return report
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Round(time.Microsecond)) / float64(time.Millisecond)
+}
+
+// writeText prints the report as a table
+func (report *timingReport) writeText(w io.Writer) error {
+
+	fmt.Fprintf(w, "--> %s timings of %d tiles and %d cells, %d workers (busy: summed over the workers)\n",
+		report.Engine, report.Tiles, report.Cells, report.Workers)
+	fmt.Fprintf(w, "\t%-10s %12s %12s\n", "stage", "wall ms", "busy ms")
+
+	for _, sr := range report.Stages {
+		fmt.Fprintf(w, "\t%-10s %12.3f %12.3f\n", sr.Name, sr.WallMs, sr.BusyMs)
+	}
+
+	_, err := fmt.Fprintf(w, "\t%-10s %12.3f\n\n", "total", report.TotalMs)
+	return err
+}
+
+func (report *timingReport) writeJSON(w io.Writer) error {
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(report)
+}
+
+// writeTimings outputs the report as the -timings flag asks: printed as
+// text or json, or written as json into a file
+func writeTimings(timings string, report *timingReport) error {
+
+	switch timings {
+	case "":
+		return nil
+	case "text":
+		return report.writeText(os.Stdout)
+	case "json":
+		return report.writeJSON(os.Stdout)
+	}
+
+	return writeFile(timings, report.writeJSON)
+}
+
+// profiling are the -cpuprofile, -memprofile, -trace and -timings
+// flags, the same in every engine
+type profiling struct {
+	cpuProfile, memProfile, traceFile, timings *string
+}
+
+// profileFlags defines the profiling flags, before flag.Parse
+func profileFlags() *profiling {
+	return &profiling{
+		cpuProfile: flag.String("cpuprofile", "", "Write a cpu profile into this file"),
+		memProfile: flag.String("memprofile", "", "Write a memory profile into this file at the end"),
+		traceFile:  flag.String("trace", "", "Write an execution trace into this file"),
+		timings:    flag.String("timings", "", "Report the time of every stage: text, json, or a file to write the json report into"),
+	}
+}
+
+// start starts the cpu profile and the trace asked for and returns the
+// stage times of the run. stop ends them, writes the memory profile and
+// reports the timings of the engine, with the tiles and cells counted
+// by then. Engines defer stop in a run that returns its errors instead
+// of exiting, so failed and cancelled runs, the slow ones worth
+// profiling, are profiled too.
+func (p *profiling) start(engine string, workers int, tiles, cells *int) (times *stageTimes, stop func(), err error) {
+
+	stopProfiling, err := startProfiling(*p.cpuProfile, *p.traceFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	times = newStageTimes()
+	tRun := time.Now()
+
+	stop = func() {
+		if *p.memProfile != "" {
+			if err := writeMemProfile(*p.memProfile); err != nil {
+				fmt.Printf("--> memory profile: %v\n", err)
+			}
+		}
+
+		report := times.report(engine, workers, *tiles, *cells, time.Since(tRun))
+		if err := writeTimings(*p.timings, report); err != nil {
+			fmt.Printf("--> timings: %v\n", err)
+		}
+
+		stopProfiling()
+	}
+
+	return times, stop, nil
+}
+
+// startProfiling starts the cpu profile and the execution trace asked
+// for, the returned stop ends and writes them
+func startProfiling(cpuProfile, traceFile string) (func(), error) {
+
+	var files []*os.File
+	stop := func() {
+		if cpuProfile != "" {
+			pprof.StopCPUProfile()
+		}
+		if traceFile != "" {
+			trace.Stop()
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err == nil {
+			files = append(files, f)
+			err = trace.Start(f)
+		}
+		if err != nil {
+			traceFile = ""
+			stop()
+			return nil, err
+		}
+	}
+
+	return stop, nil
+}
+
+// writeMemProfile writes the heap profile, of the memory in use after
+// a garbage collection and of all allocations so far
+func writeMemProfile(path string) error {
+
+	runtime.GC()
+
+	return writeFile(path, func(w io.Writer) error {
+		return pprof.Lookup("allocs").WriteTo(w, 0)
+	})
+}
+
+// writeFile creates the file at path and writes it with write
+func writeFile(path string, write func(w io.Writer) error) error {
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
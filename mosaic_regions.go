@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"regexp"
+	"strings"
+)
+
+// regionMask assigns tile libraries to the regions of the target image
+// painted in different colours on a mask image
+type regionMask struct {
+	mask   image.Image
+	target image.Rectangle
+	// mask colours and the tile libraries (directories or archives) they select
+	colours   []color.RGBA
+	libraries []string
+}
+
+// maxColourDistance is how far a mask pixel may be from a mapped colour
+// (compression noise, anti-aliased edges) to still count as that colour
+const maxColourDistance = 48
+
+// newRegionMask reads the mask image and the colour=library list,
+// e.g. #ff0000=./team,#000000=./landscapes.zip
+func newRegionMask(maskPath string, mapping string, target image.Rectangle) (*regionMask, error) {
+
+	mask, err := decodeImage(maskPath)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := &regionMask{mask: mask, target: target}
+
+	for _, field := range strings.Split(mapping, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid mask library %q, expected #rrggbb=path", field)
+		}
+
+		c, err := parseColour(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		regions.colours = append(regions.colours, c)
+		regions.libraries = append(regions.libraries, strings.TrimSpace(parts[1]))
+	}
+
+	if len(regions.colours) == 0 {
+		return nil, fmt.Errorf("-mask needs -mask-library mapping mask colours to tile libraries")
+	}
+
+	return regions, nil
+}
+
+// sources returns the tile source of every library
+func (regions *regionMask) sources(imagePattern *regexp.Regexp) map[string]tileSource {
+
+	sources := make(map[string]tileSource)
+
+	for _, library := range regions.libraries {
+		if _, err := archiveType(library); err == nil {
+			sources[library] = archiveTiles(library, imagePattern)
+		} else {
+			sources[library] = dirTiles(strings.TrimSuffix(library, "/")+"/", imagePattern)
+		}
+	}
+
+	return sources
+}
+
+// library is the tile library of the dominant mask colour of the cell,
+// "" (the default tiles) when most of the cell has no mapped colour.
+// The mask is stretched over the target when their sizes differ.
+func (regions *regionMask) library(c cell) string {
+
+	votes := make([]int, len(regions.colours)+1)
+	maskBounds := regions.mask.Bounds()
+	bounds := c.bounds.Intersect(regions.target)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			if c.mask != nil {
+				if _, _, _, a := c.mask.At(x, y).RGBA(); a == 0 {
+					continue
+				}
+			}
+
+			mx := maskBounds.Min.X + (x-regions.target.Min.X)*maskBounds.Dx()/regions.target.Dx()
+			my := maskBounds.Min.Y + (y-regions.target.Min.Y)*maskBounds.Dy()/regions.target.Dy()
+
+			votes[regions.nearest(regions.mask.At(mx, my))]++
+		}
+	}
+
+	winner := len(regions.colours)
+	for i, count := range votes {
+		if count > votes[winner] {
+			winner = i
+		}
+	}
+
+	if winner == len(regions.colours) {
+		return ""
+	}
+
+	return regions.libraries[winner]
+}
+
+// nearest returns the index of the mapped colour nearest to c,
+// len(colours) when none of them is near enough
+func (regions *regionMask) nearest(c color.Color) int {
+
+	r, g, b, _ := c.RGBA()
+
+	nearest, nearestDistance := len(regions.colours), maxColourDistance*maxColourDistance+1
+
+	for i, mapped := range regions.colours {
+		dr := int(r>>8) - int(mapped.R)
+		dg := int(g>>8) - int(mapped.G)
+		db := int(b>>8) - int(mapped.B)
+
+		if distance := dr*dr + dg*dg + db*db; distance < nearestDistance {
+			nearest, nearestDistance = i, distance
+		}
+	}
+
+	return nearest
+}
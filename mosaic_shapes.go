@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// cellShape is the shape of the tiles drawn inside the cells
+type cellShape struct {
+	kind string
+	// custom shape image, white (or opaque when the image has
+	// transparency) where the tile is drawn
+	custom      image.Image
+	customAlpha bool
+}
+
+// newCellShape reads the -shape and -shape-mask settings, a mask image
+// takes precedence over the shape name
+func newCellShape(kind string, maskPath string) (*cellShape, error) {
+
+	if maskPath != "" {
+		custom, err := decodeImage(maskPath)
+		if err != nil {
+			return nil, err
+		}
+
+		opaque, ok := custom.(interface{ Opaque() bool })
+
+		return &cellShape{kind: "mask", custom: custom, customAlpha: ok && !opaque.Opaque()}, nil
+	}
+
+	switch kind {
+	case "square", "circle", "rounded":
+		return &cellShape{kind: kind}, nil
+	}
+
+	return nil, fmt.Errorf("unknown tile shape %q (use square, circle or rounded)", kind)
+}
+
+// mask returns the shape fitted into the cell bounds, nil for squares
+func (shape *cellShape) mask(bounds image.Rectangle) image.Image {
+	if shape.kind == "square" {
+		return nil
+	}
+	return &shapeMask{shape: shape, bounds: bounds}
+}
+
+// cellStyle is how the tiles are drawn into their cells
+type cellStyle struct {
+	shape      *cellShape
+	background color.Color
+	// grout between the cells, gap/2 pixels taken from each side of a cell
+	gap       int
+	gapColour color.Color
+	// width of the lit top left and shaded bottom right tile edges
+	bevel int
+	// offset of the shadow cast by the tile towards the bottom right
+	shadow int
+	// filter scaling tiles to cells of other sizes
+	filter scaleFilter
+}
+
+// inner is the part of the cell left for the tile after the gap
+func (style *cellStyle) inner(c cell) cell {
+
+	if style.gap <= 0 {
+		return c
+	}
+
+	if c.mask == nil {
+		return cell{bounds: image.Rect(
+			c.bounds.Min.X+style.gap/2, c.bounds.Min.Y+style.gap/2,
+			c.bounds.Max.X-(style.gap-style.gap/2), c.bounds.Max.Y-(style.gap-style.gap/2))}
+	}
+
+	return cell{bounds: c.bounds, mask: erodeMask(c.mask, c.bounds, style.gap/2)}
+}
+
+// drawCell draws the tile, scaled to fit, into the cell: the shadow,
+// the background, the tile composited through the cell and tile shape
+// masks and finally the bevel
+func drawCell(dst draw.Image, c cell, tile image.Image, style *cellStyle) {
+
+	inner := style.inner(c)
+	if inner.bounds.Empty() {
+		return
+	}
+
+	mask := inner.mask
+
+	if shapeMask := style.shape.mask(inner.bounds); shapeMask != nil {
+		if mask == nil {
+			mask = shapeMask
+		} else {
+			mask = &intersectMask{mask, shapeMask}
+		}
+	}
+
+	// the shadow stays within the cell, it never darkens other tiles
+	if style.shadow > 0 {
+		offset := image.Pt(style.shadow, style.shadow)
+		shadowBounds := inner.bounds.Add(offset).Intersect(c.bounds)
+
+		var shadowMask image.Image
+		if mask != nil {
+			shadowMask = &shiftedMask{mask, offset}
+		}
+		if c.mask != nil {
+			if shadowMask == nil {
+				shadowMask = c.mask
+			} else {
+				shadowMask = &intersectMask{shadowMask, c.mask}
+			}
+		}
+
+		draw.DrawMask(dst, shadowBounds, image.NewUniform(color.RGBA{0, 0, 0, 0x80}), image.Point{},
+			shadowMask, shadowBounds.Min, draw.Over)
+	}
+
+	draw.DrawMask(dst, inner.bounds, image.NewUniform(style.background), image.Point{}, inner.mask, inner.bounds.Min, draw.Over)
+
+	scaledTile := fitTile(tile, inner.bounds, style.filter)
+	draw.DrawMask(dst, inner.bounds, scaledTile, tileOrigin(scaledTile, inner.bounds), mask, inner.bounds.Min, draw.Over)
+
+	if style.bevel > 0 {
+		light := &bevelMask{inner.bounds, style.bevel, true}
+		dark := &bevelMask{inner.bounds, style.bevel, false}
+
+		var lightMask, darkMask image.Image = light, dark
+		if mask != nil {
+			lightMask, darkMask = &intersectMask{light, mask}, &intersectMask{dark, mask}
+		}
+
+		draw.DrawMask(dst, inner.bounds, image.White, image.Point{}, lightMask, inner.bounds.Min, draw.Over)
+		draw.DrawMask(dst, inner.bounds, image.Black, image.Point{}, darkMask, inner.bounds.Min, draw.Over)
+	}
+}
+
+// shapeMask is the alpha mask of a cell shape within the cell bounds,
+// circle and rounded rectangle edges are anti-aliased
+type shapeMask struct {
+	shape  *cellShape
+	bounds image.Rectangle
+}
+
+func (m *shapeMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m *shapeMask) Bounds() image.Rectangle {
+	return m.bounds
+}
+
+func (m *shapeMask) At(x, y int) color.Color {
+
+	b := m.bounds
+	if !image.Pt(x, y).In(b) {
+		return color.Transparent
+	}
+
+	width, height := float64(b.Dx()), float64(b.Dy())
+
+	// pixel centre relative to the cell centre
+	dx := float64(x-b.Min.X) + 0.5 - width/2
+	dy := float64(y-b.Min.Y) + 0.5 - height/2
+
+	switch m.shape.kind {
+	case "circle":
+		radius := math.Min(width, height) / 2
+		return coverage(radius - math.Hypot(dx, dy))
+
+	case "rounded":
+		radius := math.Min(width, height) / 5
+
+		// distance outside of the rectangle shrunk by the corner radius
+		cx := math.Max(math.Abs(dx)-(width/2-radius), 0)
+		cy := math.Max(math.Abs(dy)-(height/2-radius), 0)
+
+		return coverage(radius - math.Hypot(cx, cy))
+
+	case "mask":
+		cb := m.shape.custom.Bounds()
+		c := m.shape.custom.At(
+			cb.Min.X+(x-b.Min.X)*cb.Dx()/b.Dx(),
+			cb.Min.Y+(y-b.Min.Y)*cb.Dy()/b.Dy())
+
+		if m.shape.customAlpha {
+			_, _, _, a := c.RGBA()
+			return color.Alpha16{uint16(a)}
+		}
+
+		return color.Alpha16{color.Gray16Model.Convert(c).(color.Gray16).Y}
+	}
+
+	return color.Opaque
+}
+
+// coverage turns the distance inside a shape edge into the alpha of a
+// pixel, half a pixel each side of the edge is blended
+func coverage(inside float64) color.Alpha {
+	return color.Alpha{uint8(math.Max(0, math.Min(1, inside+0.5)) * 255)}
+}
+
+// intersectMask is the overlap of two masks, the smaller alpha wins
+type intersectMask struct {
+	a, b image.Image
+}
+
+func (m *intersectMask) ColorModel() color.Model {
+	return color.Alpha16Model
+}
+
+func (m *intersectMask) Bounds() image.Rectangle {
+	return m.a.Bounds().Intersect(m.b.Bounds())
+}
+
+func (m *intersectMask) At(x, y int) color.Color {
+
+	_, _, _, a := m.a.At(x, y).RGBA()
+	_, _, _, b := m.b.At(x, y).RGBA()
+
+	if b < a {
+		a = b
+	}
+
+	return color.Alpha16{uint16(a)}
+}
+
+// shiftedMask is a mask moved by offset
+type shiftedMask struct {
+	mask   image.Image
+	offset image.Point
+}
+
+func (m *shiftedMask) ColorModel() color.Model {
+	return color.Alpha16Model
+}
+
+func (m *shiftedMask) Bounds() image.Rectangle {
+	return m.mask.Bounds().Add(m.offset)
+}
+
+func (m *shiftedMask) At(x, y int) color.Color {
+	return m.mask.At(x-m.offset.X, y-m.offset.Y)
+}
+
+// bevelMask covers the top and left (light) or the bottom and right
+// (dark) edge band of the bounds, half transparent
+type bevelMask struct {
+	bounds image.Rectangle
+	width  int
+	light  bool
+}
+
+func (m *bevelMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (m *bevelMask) Bounds() image.Rectangle {
+	return m.bounds
+}
+
+func (m *bevelMask) At(x, y int) color.Color {
+
+	if !image.Pt(x, y).In(m.bounds) {
+		return color.Transparent
+	}
+
+	top, left := y-m.bounds.Min.Y, x-m.bounds.Min.X
+	bottom, right := m.bounds.Max.Y-1-y, m.bounds.Max.X-1-x
+
+	// the band nearer to the pixel wins in the corners
+	lit := (top < m.width || left < m.width) && minInt(top, left) <= minInt(bottom, right)
+	shaded := (bottom < m.width || right < m.width) && !lit
+
+	if m.light && lit || !m.light && shaded {
+		return color.Alpha{0x60}
+	}
+
+	return color.Transparent
+}
+
+// erodeMask shrinks a mask by radius pixels from every edge (a minimum
+// filter over a square, run along the rows and then the columns)
+func erodeMask(mask image.Image, bounds image.Rectangle, radius int) *image.Alpha {
+
+	eroded := image.NewAlpha(bounds)
+	draw.Draw(eroded, bounds, mask, bounds.Min, draw.Src)
+
+	if radius <= 0 {
+		return eroded
+	}
+
+	width, height := bounds.Dx(), bounds.Dy()
+	line := make([]uint8, width+height)
+
+	// pixels outside of the bounds count as transparent
+	erodeLine := func(get func(i int) uint8, set func(i int, v uint8), length int) {
+		for i := 0; i < length; i++ {
+			line[i] = get(i)
+		}
+		for i := 0; i < length; i++ {
+			v := uint8(0xff)
+			for j := i - radius; j <= i+radius; j++ {
+				if j < 0 || j >= length {
+					v = 0
+					break
+				}
+				if line[j] < v {
+					v = line[j]
+				}
+			}
+			set(i, v)
+		}
+	}
+
+	for y := 0; y < height; y++ {
+		row := eroded.Pix[y*eroded.Stride:]
+		erodeLine(func(i int) uint8 { return row[i] }, func(i int, v uint8) { row[i] = v }, width)
+	}
+
+	for x := 0; x < width; x++ {
+		erodeLine(func(i int) uint8 { return eroded.Pix[i*eroded.Stride+x] },
+			func(i int, v uint8) { eroded.Pix[i*eroded.Stride+x] = v }, height)
+	}
+
+	return eroded
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// loadTile gets the tile image, the (expensive) decoding is left to
+// the decode stage calling it
+type loadTile struct {
+	// data is the encoded tile read by the source, nil for tiles made in
+	// memory. Tiles with data can be found in the tile cache.
+	data []byte
+	load func() (image.Image, error)
+	// reload reads the tile again where the source found it, for lazily
+	// loaded tiles, so they don't keep data. It is nil for tiles made in
+	// memory, they are loaded again by load.
+	reload func() (image.Image, error)
+}
+
+func (load loadTile) image() (image.Image, error) {
+	return load.load()
+}
+
+// reloader loads the tile again when it is drawn
+func (load loadTile) reloader() func() (image.Image, error) {
+
+	if load.reload != nil {
+		return load.reload
+	}
+
+	return load.load
+}
+
+// emitTile hands a tile over to the tile processing, it fails when the
+// processing was cancelled and the source should stop
+type emitTile func(name string, load loadTile) error
+
+// loaded wraps a tile image that is already in memory
+func loaded(tileImage image.Image) loadTile {
+	return loadTile{load: func() (image.Image, error) {
+		return tileImage, nil
+	}}
+}
+
+// generated makes the tile image when the decode stage asks for it
+func generated(generate func() image.Image) loadTile {
+	return loadTile{load: func() (image.Image, error) {
+		return generate(), nil
+	}}
+}
+
+// decoded decodes the tile image from data read by the source
+func decoded(data []byte) loadTile {
+	return loadTile{data: data, load: func() (image.Image, error) {
+		tileImage, _, err := image.Decode(bytes.NewReader(data))
+		return tileImage, err
+	}}
+}
+
+// reread decodes the tile name from the data read returns, each time
+// it is reloaded
+func reread(name string, read func() ([]byte, error)) func() (image.Image, error) {
+	return func() (image.Image, error) {
+
+		data, err := read()
+		if err != nil {
+			return nil, readError(name, err)
+		}
+
+		return decoded(data).image()
+	}
+}
+
+// failed passes the error of a tile the source could not read on, to
+// be reported along with the tiles that fail to decode
+func failed(err error) loadTile {
+	return loadTile{load: func() (image.Image, error) {
+		return nil, err
+	}}
+}
+
+// tileSource produces the tile library, calling emit for every tile
+type tileSource func(emit emitTile) error
+
+// dirTiles reads the tile photos from a directory
+func dirTiles(imageDir string, imagePattern *regexp.Regexp) tileSource {
+	return func(emit emitTile) error {
+
+		tileFiles, err := ioutil.ReadDir(imageDir)
+		if err != nil {
+			return err
+		}
+
+		for _, fileTile := range tileFiles {
+			filename := fileTile.Name()
+
+			if !imagePattern.MatchString(filename) {
+				continue
+			}
+
+			path := imageDir + filename
+			data, err := ioutil.ReadFile(path)
+
+			load := decoded(data)
+			load.reload = reread(filename, func() ([]byte, error) { return ioutil.ReadFile(path) })
+			if err != nil {
+				load = failed(readError(filename, err))
+			}
+
+			if err := emit(filename, load); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// selfTiles slices an image into crops used as tiles. For every scale
+// the image is cut into scale x scale crops, taken at half crop steps
+// so that the crops overlap.
+func selfTiles(name string, source image.Image, scales []int) tileSource {
+	return func(emit emitTile) error {
+
+		bounds := source.Bounds()
+
+		for _, scale := range scales {
+			if scale <= 0 {
+				return fmt.Errorf("self tile scale must be > 0, got %d", scale)
+			}
+
+			cropWidth := bounds.Dx() / scale
+			cropHeight := bounds.Dy() / scale
+
+			if cropWidth <= 0 || cropHeight <= 0 {
+				continue
+			}
+
+			xStep, yStep := cropWidth/2, cropHeight/2
+			if xStep == 0 {
+				xStep = 1
+			}
+			if yStep == 0 {
+				yStep = 1
+			}
+
+			for y := bounds.Min.Y; y+cropHeight <= bounds.Max.Y; y += yStep {
+				for x := bounds.Min.X; x+cropWidth <= bounds.Max.X; x += xStep {
+					crop := image.Rect(x, y, x+cropWidth, y+cropHeight)
+
+					if err := emit(cropName(name, crop), loaded(cropImage(source, crop))); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// cropName identifies a crop of an image, e.g. origImage.jpg[0,0,64,48]
+func cropName(name string, r image.Rectangle) string {
+	return fmt.Sprintf("%s[%d,%d,%d,%d]", name, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+}
+
+// cropImage returns the part of img inside r, sharing the pixels
+// when the image type supports it
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+
+	crop := image.NewRGBA(r)
+	draw.Draw(crop, r, img, r.Min, draw.Src)
+
+	return crop
+}
+
+// decodeImage reads an image file in any of the registered formats
+func decodeImage(path string) (image.Image, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(bufio.NewReader(file))
+	if err != nil {
+		return nil, decodeError(path, err)
+	}
+
+	return img, nil
+}
+
+// parseInts reads a comma separated list of integers, e.g. 2,4,8
+func parseInts(list string) ([]int, error) {
+
+	var ints []int
+
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		i, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, err
+		}
+
+		ints = append(ints, i)
+	}
+
+	return ints, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// atlasFrame is a sprite position in a json atlas (TexturePacker format)
+type atlasFrame struct {
+	Filename string `json:"filename"`
+	Frame    struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+		W int `json:"w"`
+		H int `json:"h"`
+	} `json:"frame"`
+	Rotated bool `json:"rotated"`
+}
+
+// spriteTiles slices a sprite sheet into cellWidth x cellHeight tiles,
+// row by row. Empty (fully transparent) cells are skipped.
+func spriteTiles(name string, sheet image.Image, cellWidth, cellHeight int) tileSource {
+	return func(emit emitTile) error {
+
+		if cellWidth <= 0 || cellHeight <= 0 {
+			return fmt.Errorf("sprite cell size must be > 0, got %dx%d", cellWidth, cellHeight)
+		}
+
+		bounds := sheet.Bounds()
+
+		for y := bounds.Min.Y; y+cellHeight <= bounds.Max.Y; y += cellHeight {
+			for x := bounds.Min.X; x+cellWidth <= bounds.Max.X; x += cellWidth {
+				cell := cropImage(sheet, image.Rect(x, y, x+cellWidth, y+cellHeight))
+
+				if isTransparent(cell) {
+					continue
+				}
+
+				if err := emit(cropName(name, cell.Bounds()), loaded(cell)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// atlasTiles cuts the sprites described by a json atlas out of the sheet
+func atlasTiles(name string, sheet image.Image, atlasPath string) tileSource {
+	return func(emit emitTile) error {
+
+		frames, err := readAtlas(atlasPath)
+		if err != nil {
+			return err
+		}
+
+		for _, frame := range frames {
+			r := image.Rect(frame.Frame.X, frame.Frame.Y, frame.Frame.X+frame.Frame.W, frame.Frame.Y+frame.Frame.H)
+
+			// rotated sprites are stored turned clockwise with width and height swapped
+			if frame.Rotated {
+				r = image.Rect(frame.Frame.X, frame.Frame.Y, frame.Frame.X+frame.Frame.H, frame.Frame.Y+frame.Frame.W)
+			}
+
+			r = r.Add(sheet.Bounds().Min)
+			if !r.In(sheet.Bounds()) || r.Empty() {
+				return fmt.Errorf("sprite %q %v lies outside of the sheet %v", frame.Filename, r, sheet.Bounds())
+			}
+
+			sprite := cropImage(sheet, r)
+			if frame.Rotated {
+				sprite = rotate270(sprite)
+			}
+
+			if err := emit(name+"#"+frame.Filename, loaded(sprite)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// readAtlas reads both the hash ({"frames": {"name": {...}}}) and the
+// array ({"frames": [{"filename": "name", ...}]}) atlas layouts
+func readAtlas(atlasPath string) ([]atlasFrame, error) {
+
+	data, err := ioutil.ReadFile(atlasPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var atlas struct {
+		Frames json.RawMessage `json:"frames"`
+	}
+
+	if err := json.Unmarshal(data, &atlas); err != nil {
+		return nil, fmt.Errorf("%s: %v", atlasPath, err)
+	}
+
+	var frames []atlasFrame
+
+	if err := json.Unmarshal(atlas.Frames, &frames); err == nil {
+		return frames, nil
+	}
+
+	var named map[string]atlasFrame
+
+	if err := json.Unmarshal(atlas.Frames, &named); err != nil {
+		return nil, fmt.Errorf("%s: frames must be a list or an object: %v", atlasPath, err)
+	}
+
+	for filename, frame := range named {
+		frame.Filename = filename
+		frames = append(frames, frame)
+	}
+
+	sort.Slice(frames, func(i, j int) bool { return frames[i].Filename < frames[j].Filename })
+
+	return frames, nil
+}
+
+// isTransparent reports whether all pixels of img are fully transparent
+func isTransparent(img image.Image) bool {
+
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return false
+	}
+
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// parseSize reads a size given as WxH, or as a single number for squares
+func parseSize(size string) (int, int, error) {
+
+	parts := strings.SplitN(strings.ToLower(size), "x", 2)
+
+	width, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	if len(parts) == 1 {
+		return width, width, nil
+	}
+
+	height, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// pico8Palette is the palette used when -palette is not given
+const pico8Palette = "#000000,#1d2b53,#7e2553,#008751,#ab5236,#5f574f,#c2c3c7,#fff1e8," +
+	"#ff004d,#ffa300,#ffec27,#00e436,#29adff,#83769c,#ff77a8,#ffccaa"
+
+// synthTiles generates tiles from a palette: solid swatches, two-stop
+// gradients between every pair of colours and noise textures, depending
+// on the requested kinds. Each pair has one gradient, the reversed one
+// has the same colour and is its horizontal flip (-augment flip).
+func synthTiles(kinds string, palette []color.RGBA, size int) tileSource {
+	return func(emit emitTile) error {
+
+		if size <= 0 {
+			return fmt.Errorf("synthetic tile size must be > 0, got %d", size)
+		}
+
+		for _, kind := range strings.Split(kinds, ",") {
+			switch strings.TrimSpace(kind) {
+			case "solid":
+				for _, c := range palette {
+					c := c
+					if err := emit("solid"+hexColour(c), generated(func() image.Image { return solidTile(c, size) })); err != nil {
+						return err
+					}
+				}
+			case "gradient":
+				for i, from := range palette {
+					for _, to := range palette[i+1:] {
+						if from == to {
+							continue
+						}
+
+						from, to := from, to
+						if err := emit("gradient"+hexColour(from)+"-"+strings.TrimPrefix(hexColour(to), "#"),
+							generated(func() image.Image { return gradientTile(from, to, size) })); err != nil {
+							return err
+						}
+					}
+				}
+			case "noise":
+				for i, c := range palette {
+					i, c := i, c
+					if err := emit("noise"+hexColour(c), generated(func() image.Image { return noiseTile(c, size, int64(i)) })); err != nil {
+						return err
+					}
+				}
+			default:
+				return fmt.Errorf("unknown synthetic tile kind %q (use solid, gradient or noise)", kind)
+			}
+		}
+
+		return nil
+	}
+}
+
+func solidTile(c color.RGBA, size int) image.Image {
+
+	tile := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(tile, tile.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	return tile
+}
+
+// gradientTile blends from one colour on the left to the other on the right
+func gradientTile(from, to color.RGBA, size int) image.Image {
+
+	tile := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for x := 0; x < size; x++ {
+		t := 0.0
+		if size > 1 {
+			t = float64(x) / float64(size-1)
+		}
+
+		c := color.RGBA{
+			uint8(float64(from.R) + t*(float64(to.R)-float64(from.R))),
+			uint8(float64(from.G) + t*(float64(to.G)-float64(from.G))),
+			uint8(float64(from.B) + t*(float64(to.B)-float64(from.B))),
+			255,
+		}
+
+		for y := 0; y < size; y++ {
+			tile.SetRGBA(x, y, c)
+		}
+	}
+
+	return tile
+}
+
+// noiseTile scatters random brightness changes around the colour,
+// the seed keeps the texture the same between runs
+func noiseTile(c color.RGBA, size int, seed int64) image.Image {
+
+	random := rand.New(rand.NewSource(seed))
+	tile := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	jitter := func(v uint8, d int) uint8 {
+		n := int(v) + d
+		if n < 0 {
+			return 0
+		}
+		if n > 255 {
+			return 255
+		}
+		return uint8(n)
+	}
+
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := random.Intn(65) - 32
+			tile.SetRGBA(x, y, color.RGBA{jitter(c.R, d), jitter(c.G, d), jitter(c.B, d), 255})
+		}
+	}
+
+	return tile
+}
+
+// parsePalette reads a comma separated list of hex colours
+func parsePalette(list string) ([]color.RGBA, error) {
+
+	var palette []color.RGBA
+
+	for _, field := range strings.Split(list, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+
+		c, err := parseColour(field)
+		if err != nil {
+			return nil, err
+		}
+
+		palette = append(palette, c)
+	}
+
+	if len(palette) == 0 {
+		return nil, fmt.Errorf("empty palette %q", list)
+	}
+
+	return palette, nil
+}
+
+// parseColour reads a #rrggbb (or rrggbb) hex colour
+func parseColour(hex string) (color.RGBA, error) {
+
+	hex = strings.TrimPrefix(strings.TrimSpace(hex), "#")
+
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid colour %q, expected #rrggbb", hex)
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid colour %q, expected #rrggbb", hex)
+	}
+
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+func hexColour(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"math/rand"
+)
+
+// voronoiGrid splits the image into the Voronoi regions of count seed
+// points, every region becoming a cell masked to its shape. The passes
+// over the pixels check the context every row.
+func voronoiGrid(ctx context.Context, img image.Image, count int, seeds string) ([]cell, error) {
+
+	if count <= 0 {
+		return nil, fmt.Errorf("number of voronoi cells must be > 0, got %d", count)
+	}
+
+	bounds := img.Bounds()
+
+	// fixed seed, the same image gives the same mosaic
+	random := rand.New(rand.NewSource(1))
+
+	var points []image.Point
+	var err error
+
+	switch seeds {
+	case "random":
+		points = randomSeeds(bounds, count, random)
+	case "poisson":
+		points = poissonSeeds(bounds, count, random)
+	case "edge":
+		points, err = edgeSeeds(ctx, img, count, random)
+	default:
+		return nil, fmt.Errorf("unknown voronoi seeds %q (use random, poisson or edge)", seeds)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := voronoiLabels(ctx, bounds, points)
+	if err != nil {
+		return nil, err
+	}
+
+	// bounding box of every region
+	regions := make([]image.Rectangle, len(points))
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			label := labels[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X]
+			regions[label] = regions[label].Union(image.Rect(x, y, x+1, y+1))
+		}
+	}
+
+	var cells []cell
+
+	for label, region := range regions {
+		if region.Empty() {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		mask := image.NewAlpha(region)
+
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			for x := region.Min.X; x < region.Max.X; x++ {
+				if labels[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] == label {
+					mask.Pix[mask.PixOffset(x, y)] = 0xff
+				}
+			}
+		}
+
+		cells = append(cells, cell{bounds: region, mask: mask})
+	}
+
+	return cells, nil
+}
+
+// voronoiLabels finds the nearest seed of every pixel. Seeds are put into
+// buckets, the search around a pixel goes ring by ring of buckets and
+// stops once no bucket further out can hold a nearer seed.
+func voronoiLabels(ctx context.Context, bounds image.Rectangle, points []image.Point) ([]int, error) {
+
+	bucketSize := int(math.Sqrt(float64(bounds.Dx()*bounds.Dy())/float64(len(points)))) + 1
+	columns := bounds.Dx()/bucketSize + 1
+	rows := bounds.Dy()/bucketSize + 1
+
+	buckets := make([][]int, columns*rows)
+	for i, p := range points {
+		column, row := (p.X-bounds.Min.X)/bucketSize, (p.Y-bounds.Min.Y)/bucketSize
+		buckets[row*columns+column] = append(buckets[row*columns+column], i)
+	}
+
+	labels := make([]int, bounds.Dx()*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+
+			column, row := (x-bounds.Min.X)/bucketSize, (y-bounds.Min.Y)/bucketSize
+			nearest, nearestDistance := -1, math.MaxFloat64
+
+			for ring := 0; ring <= columns+rows; ring++ {
+				for r := row - ring; r <= row+ring; r++ {
+					for c := column - ring; c <= column+ring; c++ {
+
+						onRing := r == row-ring || r == row+ring || c == column-ring || c == column+ring
+						if !onRing || r < 0 || r >= rows || c < 0 || c >= columns {
+							continue
+						}
+
+						for _, i := range buckets[r*columns+c] {
+							dx, dy := float64(points[i].X-x), float64(points[i].Y-y)
+							if distance := dx*dx + dy*dy; distance < nearestDistance {
+								nearest, nearestDistance = i, distance
+							}
+						}
+					}
+				}
+
+				reach := float64(ring * bucketSize)
+				if nearest >= 0 && nearestDistance <= reach*reach {
+					break
+				}
+			}
+
+			labels[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] = nearest
+		}
+	}
+
+	return labels, nil
+}
+
+func randomSeeds(bounds image.Rectangle, count int, random *rand.Rand) []image.Point {
+
+	points := make([]image.Point, count)
+
+	for i := range points {
+		points[i] = image.Pt(bounds.Min.X+random.Intn(bounds.Dx()), bounds.Min.Y+random.Intn(bounds.Dy()))
+	}
+
+	return points
+}
+
+// poissonSeeds spreads about count points evenly, no two of them closer
+// than a minimum distance (Bridson's Poisson-disc sampling)
+func poissonSeeds(bounds image.Rectangle, count int, random *rand.Rand) []image.Point {
+
+	const attempts = 30
+
+	radius := 0.8 * math.Sqrt(float64(bounds.Dx()*bounds.Dy())/float64(count))
+	cellSize := radius / math.Sqrt2
+
+	columns := int(float64(bounds.Dx())/cellSize) + 1
+	rows := int(float64(bounds.Dy())/cellSize) + 1
+
+	// background grid holding at most one point per cell
+	grid := make([]int, columns*rows)
+	for i := range grid {
+		grid[i] = -1
+	}
+
+	var points, active []image.Point
+
+	add := func(p image.Point) {
+		column := int(float64(p.X-bounds.Min.X) / cellSize)
+		row := int(float64(p.Y-bounds.Min.Y) / cellSize)
+		grid[row*columns+column] = len(points)
+		points = append(points, p)
+		active = append(active, p)
+	}
+
+	farEnough := func(p image.Point) bool {
+		column := int(float64(p.X-bounds.Min.X) / cellSize)
+		row := int(float64(p.Y-bounds.Min.Y) / cellSize)
+
+		for r := row - 2; r <= row+2; r++ {
+			for c := column - 2; c <= column+2; c++ {
+				if r < 0 || r >= rows || c < 0 || c >= columns || grid[r*columns+c] < 0 {
+					continue
+				}
+				q := points[grid[r*columns+c]]
+				dx, dy := float64(q.X-p.X), float64(q.Y-p.Y)
+				if dx*dx+dy*dy < radius*radius {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	add(image.Pt(bounds.Min.X+random.Intn(bounds.Dx()), bounds.Min.Y+random.Intn(bounds.Dy())))
+
+	for len(active) > 0 {
+		i := random.Intn(len(active))
+		p := active[i]
+
+		found := false
+		for attempt := 0; attempt < attempts; attempt++ {
+			angle := random.Float64() * 2 * math.Pi
+			distance := radius * (1 + random.Float64())
+
+			candidate := image.Pt(
+				p.X+int(distance*math.Cos(angle)),
+				p.Y+int(distance*math.Sin(angle)))
+
+			if candidate.In(bounds) && farEnough(candidate) {
+				add(candidate)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			active = append(active[:i], active[i+1:]...)
+		}
+	}
+
+	return points
+}
+
+// edgeSeeds places more points where the image has edges, so that the
+// cells get small along outlines and large over flat areas
+func edgeSeeds(ctx context.Context, img image.Image, count int, random *rand.Rand) ([]image.Point, error) {
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	luminance := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luminance[y*width+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+		}
+	}
+
+	// gradient magnitude by central differences
+	edges := make([]float64, width*height)
+	strongest := 0.0
+
+	for y := 1; y < height-1; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		for x := 1; x < width-1; x++ {
+			dx := luminance[y*width+x+1] - luminance[y*width+x-1]
+			dy := luminance[(y+1)*width+x] - luminance[(y-1)*width+x]
+
+			edges[y*width+x] = math.Sqrt(dx*dx + dy*dy)
+			if edges[y*width+x] > strongest {
+				strongest = edges[y*width+x]
+			}
+		}
+	}
+
+	// flat areas still get some seeds
+	base := strongest / 10
+	if base == 0 {
+		base = 1
+	}
+
+	points := make([]image.Point, 0, count)
+
+	for len(points) < count {
+		x, y := random.Intn(width), random.Intn(height)
+
+		if random.Float64()*(strongest+base) < edges[y*width+x]+base {
+			points = append(points, image.Pt(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return points, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"image"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// atOnly hides the type of the image, so readRow falls back to image.At
+type atOnly struct {
+	image.Image
+}
+
+// testImages are the image types readRow reads directly, filled with
+// random pixels, their bounds not starting at 0
+func testImages(width, height int) map[string]image.Image {
+
+	random := rand.New(rand.NewSource(1))
+	r := image.Rect(3, 5, 3+width, 5+height)
+
+	ycbcr := image.NewYCbCr(r, image.YCbCrSubsampleRatio420)
+	rgba := image.NewRGBA(r)
+	nrgba := image.NewNRGBA(r)
+	gray := image.NewGray(r)
+
+	for _, pix := range [][]byte{ycbcr.Y, ycbcr.Cb, ycbcr.Cr, rgba.Pix, nrgba.Pix, gray.Pix} {
+		random.Read(pix)
+	}
+
+	// premultiplied colours cannot exceed their alpha
+	for i := 0; i < len(rgba.Pix); i += 4 {
+		a := rgba.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			rgba.Pix[i+c] = byte(int(rgba.Pix[i+c]) * int(a) / 255)
+		}
+	}
+
+	return map[string]image.Image{"YCbCr": ycbcr, "RGBA": rgba, "NRGBA": nrgba, "Gray": gray}
+}
+
+func TestReadRow(t *testing.T) {
+
+	for name, img := range testImages(37, 21) {
+		bounds := img.Bounds()
+		row := make([]uint32, 3*bounds.Dx())
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			// a row part, as read for the cells
+			xMin := bounds.Min.X + y%5
+
+			readRow(img, y, xMin, bounds.Max.X, row)
+
+			for x := xMin; x < bounds.Max.X; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				got := row[3*(x-xMin) : 3*(x-xMin)+3]
+
+				if got[0] != r || got[1] != g || got[2] != b {
+					t.Fatalf("%s (%d, %d): readRow %v, At %v", name, x, y, got, []uint32{r, g, b})
+				}
+			}
+		}
+	}
+}
+
+func TestGetImageColour(t *testing.T) {
+
+	for name, img := range testImages(37, 21) {
+		bounds := img.Bounds()
+
+		for _, r := range []image.Rectangle{bounds, image.Rect(5, 8, 20, 17), bounds.Inset(-4)} {
+			fast := getImageColour(img, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+			at := getImageColour(atOnly{img}, r.Min.X, r.Min.Y, r.Max.X, r.Max.Y)
+
+			if !reflect.DeepEqual(fast, at) {
+				t.Errorf("%s %v: %v, with At %v", name, r, fast, at)
+			}
+		}
+	}
+}
+
+// the benchmarks average a tile sized image, each image type directly
+// and through image.At
+func BenchmarkGetImageColour(b *testing.B) {
+
+	for _, name := range []string{"YCbCr", "RGBA", "NRGBA", "Gray"} {
+		img := testImages(256, 256)[name]
+		bounds := img.Bounds()
+
+		for _, read := range []struct {
+			name string
+			img  image.Image
+		}{{"direct", img}, {"At", atOnly{img}}} {
+			b.Run(name+"/"+read.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					getImageColour(read.img, bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkReadRow(b *testing.B) {
+
+	for _, name := range []string{"YCbCr", "RGBA", "NRGBA", "Gray"} {
+		img := testImages(1024, 2)[name]
+		bounds := img.Bounds()
+		row := make([]uint32, 3*bounds.Dx())
+
+		for _, read := range []struct {
+			name string
+			img  image.Image
+		}{{"direct", img}, {"At", atOnly{img}}} {
+			b.Run(name+"/"+read.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					readRow(read.img, bounds.Min.Y, bounds.Min.X, bounds.Max.X, row)
+				}
+			})
+		}
+	}
+}